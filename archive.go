@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// archive is set in record and replay modes
+var archive *Archive
+
+// Archive keeps fetched pages in a directory, a file per page and
+// index.txt with "url<TAB>file" lines, so a job can be run again offline
+//
+//	index.txt
+//	pages/3f786850e387550fdab836ed7e6dc881de23001b.html
+type Archive struct {
+	*sync.Mutex
+	dir   string
+	index map[string]string
+}
+
+func OpenArchive(dir string) (*Archive, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "pages"), 0755); err != nil {
+		return nil, err
+	}
+	a := &Archive{&sync.Mutex{}, dir, map[string]string{}}
+
+	file, err := os.Open(a.indexPath())
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		kv := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s:%d: want url<TAB>file", a.indexPath(), n)
+		}
+		// a page recorded again overwrites its file and keeps its line,
+		// for a hand edited index the last line wins
+		a.index[kv[0]] = kv[1]
+	}
+	return a, scanner.Err()
+}
+
+// Get returns the recorded page
+func (a *Archive) Get(uri string) (string, error) {
+	a.Lock()
+	name, ok := a.index[normalizeURL(uri)]
+	a.Unlock()
+	if !ok {
+		return "", fmt.Errorf("Not recorded %s", uri)
+	}
+	body, err := ioutil.ReadFile(filepath.Join(a.dir, name))
+	return string(body), err
+}
+
+func (a *Archive) Put(uri, body string) error {
+	key := normalizeURL(uri)
+	sum := sha1.Sum([]byte(key))
+	name := filepath.Join("pages", hex.EncodeToString(sum[:])+".html")
+
+	a.Lock()
+	defer a.Unlock()
+	if err := ioutil.WriteFile(filepath.Join(a.dir, name), []byte(body), 0644); err != nil {
+		return err
+	}
+	if _, ok := a.index[key]; ok {
+		return nil
+	}
+	file, err := os.OpenFile(a.indexPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(file, "%s\t%s\n", key, name); err != nil {
+		file.Close()
+		return err
+	}
+	a.index[key] = name
+	return file.Close()
+}
+
+func (a *Archive) indexPath() string {
+	return filepath.Join(a.dir, "index.txt")
+}
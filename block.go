@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+)
+
+// BlockSpec tells a captcha or "access denied" page from a product page.
+// Any matching selector, body pattern or redirect target means blocked.
+type BlockSpec struct {
+	Selectors []string `json:"selectors"`
+	// Regular expressions for the page body
+	Patterns []string `json:"patterns"`
+	// Regular expressions for the Location of a redirect
+	Redirects []string `json:"redirects"`
+
+	patterns  []*regexp.Regexp
+	redirects []*regexp.Regexp
+}
+
+// compile checks the spec and prepares its expressions, it is done when the
+// shop is validated
+func (b *BlockSpec) compile() error {
+	for _, s := range b.Selectors {
+		if _, err := cascadia.Compile(s); err != nil {
+			return fmt.Errorf("selector %q: %v", s, err)
+		}
+	}
+	b.patterns = b.patterns[:0]
+	for _, p := range b.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return err
+		}
+		b.patterns = append(b.patterns, re)
+	}
+	b.redirects = b.redirects[:0]
+	for _, p := range b.Redirects {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return err
+		}
+		b.redirects = append(b.redirects, re)
+	}
+	return nil
+}
+
+// Detect returns why the response is a block page, the empty string when it
+// is not one. The body of a failed response is checked as well as its
+// redirect target, a 403 is a block even when nothing matches.
+func (b *BlockSpec) Detect(body string, err error) string {
+	if err == nil {
+		return b.detectPage(body)
+	}
+	e, ok := err.(*StatusError)
+	if !ok {
+		return ""
+	}
+	if reason := b.detectRedirect(e.Location); reason != "" {
+		return reason
+	}
+	if reason := b.detectPage(e.body); reason != "" {
+		return reason
+	}
+	if e.Code == http.StatusForbidden {
+		return "403 Forbidden"
+	}
+	return ""
+}
+
+func (b *BlockSpec) detectRedirect(location string) string {
+	if b == nil || location == "" {
+		return ""
+	}
+	for _, re := range b.redirects {
+		if re.MatchString(location) {
+			return "redirect to " + location
+		}
+	}
+	return ""
+}
+
+func (b *BlockSpec) detectPage(body string) string {
+	if b == nil || body == "" {
+		return ""
+	}
+	for _, re := range b.patterns {
+		if re.MatchString(body) {
+			return "body matches " + re.String()
+		}
+	}
+	if len(b.Selectors) == 0 {
+		return ""
+	}
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	for _, s := range b.Selectors {
+		if doc.Find(s).Length() > 0 {
+			return "page has " + s
+		}
+	}
+	return ""
+}
+
+// BlockedError is a block page the shop showed instead of the product
+type BlockedError struct {
+	URI    string
+	Reason string
+}
+
+func (e *BlockedError) Error() string {
+	return fmt.Sprintf("Blocked at %s: %s", e.URI, e.Reason)
+}
+
+// isBlocked tells if the shop refused us rather than the page
+func isBlocked(err error) bool {
+	switch e := err.(type) {
+	case *BlockedError:
+		return true
+	case *StatusError:
+		return e.Code == http.StatusTooManyRequests
+	}
+	return false
+}
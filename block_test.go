@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestBlockDetect(t *testing.T) {
+	b := &BlockSpec{
+		Selectors: []string{".g-recaptcha"},
+		Patterns:  []string{"(?i)access denied"},
+		Redirects: []string{"captcha"},
+	}
+	if err := b.compile(); err != nil {
+		t.Fatal(err)
+	}
+	var none *BlockSpec
+
+	tests := []struct {
+		spec    *BlockSpec
+		body    string
+		err     error
+		blocked bool
+	}{
+		{b, "<html>product</html>", nil, false},
+		{b, "<html>Access Denied</html>", nil, true},
+		{b, `<div class="g-recaptcha"></div>`, nil, true},
+		{b, "", &StatusError{Code: 302, Location: "/captcha?r=1"}, true},
+		{b, "", &StatusError{Code: 302, Location: "/cart"}, false},
+		{b, "", &StatusError{Code: 404, body: "Access denied"}, true},
+		{b, "", &StatusError{Code: 403}, true},
+		{b, "", &StatusError{Code: 404}, false},
+		{none, "Access denied", nil, false},
+		{none, "", &StatusError{Code: 403}, true},
+	}
+	for i, test := range tests {
+		reason := test.spec.Detect(test.body, test.err)
+		if (reason != "") != test.blocked {
+			t.Errorf("#%d: got %q, want blocked %v", i, reason, test.blocked)
+		}
+	}
+}
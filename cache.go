@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var pageCache *PageCache
+
+// Page is a fetched page and what is needed to revalidate it
+type Page struct {
+	URL          string    `json:"url"`
+	Body         string    `json:"body"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+	// the page came from the cache after a 304 response
+	revalidated bool
+}
+
+func (p *Page) text() string {
+	if p == nil {
+		return ""
+	}
+	return p.Body
+}
+
+// PageCache keeps fetched product pages on disk, a file per page
+type PageCache struct {
+	dir string
+}
+
+func OpenPageCache(dir string) (*PageCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &PageCache{dir}, nil
+}
+
+// Get returns the cached page, nil when there is none or the cache is off
+func (c *PageCache) Get(key string) *Page {
+	if c == nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		return nil
+	}
+	page := &Page{}
+	if err := json.Unmarshal(data, page); err != nil {
+		return nil
+	}
+	return page
+}
+
+func (c *PageCache) Put(key string, page *Page) error {
+	if c == nil {
+		return nil
+	}
+	data, err := json.Marshal(page)
+	if err != nil {
+		return err
+	}
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// readers never see a half written page
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (c *PageCache) path(key string) string {
+	sum := sha1.Sum([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(c.dir, name[:2], name)
+}
+
+// normalizeURL makes the cache key, URLs that differ only in case of the
+// host, a default port, order of the query or a fragment are the same page
+func normalizeURL(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if u.Scheme == "http" {
+		u.Host = strings.TrimSuffix(u.Host, ":80")
+	} else if u.Scheme == "https" {
+		u.Host = strings.TrimSuffix(u.Host, ":443")
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.RawQuery = u.Query().Encode()
+	u.Fragment = ""
+	return u.String()
+}
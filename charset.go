@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+)
+
+// toUTF8 converts the page to UTF-8 for the extractors. The charset is
+// taken from the Content-Type header, a BOM or a meta tag. A page that does
+// not declare it is UTF-8 when it is valid as one, otherwise it is in the
+// fallback charset.
+func toUTF8(body []byte, contentType, fallback string) (string, error) {
+	e, name, certain := charset.DetermineEncoding(body, contentType)
+	// windows-1252 is what DetermineEncoding guesses when it found nothing
+	if !certain && name == "windows-1252" {
+		if utf8.Valid(body) {
+			return string(body), nil
+		}
+		e, name = charset.Lookup(fallback)
+		if e == nil {
+			return "", fmt.Errorf("Unknown charset %q", fallback)
+		}
+	}
+	if e == encoding.Nop || name == "utf-8" {
+		return string(body), nil
+	}
+	decoded, err := e.NewDecoder().Bytes(body)
+	if err != nil {
+		return "", fmt.Errorf("Decoding %s: %v", name, err)
+	}
+	return string(decoded), nil
+}
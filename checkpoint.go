@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+
+	"github.com/boltdb/bolt"
+)
+
+// Checkpoint keeps scraped offers of a job, so a job resumed after a restart
+// does not scrape them again
+type Checkpoint struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+func (s *JobStore) Checkpoint(jobID uint64) (*Checkpoint, error) {
+	bucket := checkpointBucket(jobID)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Checkpoint{s.db, bucket}, nil
+}
+
+func (c *Checkpoint) Get(offerID string) (CheckpointedProduct, bool) {
+	var product CheckpointedProduct
+	c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(c.bucket)
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(offerID)); v != nil {
+			product = append(product, v...)
+		}
+		return nil
+	})
+	return product, product != nil
+}
+
+func (c *Checkpoint) Put(offerID string, product interface{}) error {
+	v, err := xml.Marshal(product)
+	if err != nil {
+		return err
+	}
+	return c.db.Batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket(c.bucket)
+		if b == nil {
+			return fmt.Errorf("No checkpoint %s", c.bucket)
+		}
+		return b.Put([]byte(offerID), v)
+	})
+}
+
+func (c *Checkpoint) Count() int {
+	var n int
+	c.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(c.bucket); b != nil {
+			n = b.Stats().KeyN
+		}
+		return nil
+	})
+	return n
+}
+
+func checkpointBucket(jobID uint64) []byte {
+	return []byte(fmt.Sprintf("checkpoint-%d", jobID))
+}
+
+// CheckpointedProduct is a product restored from a checkpoint or the offer
+// store, it is written to the feed as it was stored
+type CheckpointedProduct []byte
+
+func (c CheckpointedProduct) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	d := xml.NewDecoder(bytes.NewReader(c))
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := e.EncodeToken(token); err != nil {
+			return err
+		}
+	}
+}
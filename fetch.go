@@ -0,0 +1,310 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/andybalholm/brotli"
+	"github.com/golang/glog"
+)
+
+// GetBody returns the page from the cache while it is fresh, otherwise
+// fetches it. A stale cached page is revalidated with the shop. In replay
+// mode the page comes from the archive only.
+func GetBody(ctx context.Context, state *ParserState, fetch FetchSpec, uri string) (string, error) {
+	if *replay != "" {
+		return archive.Get(uri)
+	}
+	body, err := getBody(ctx, state, fetch, uri)
+	if err == nil && *record != "" {
+		if err := archive.Put(uri, body); err != nil {
+			glog.Errorln(err)
+		}
+	}
+	return body, err
+}
+
+func getBody(ctx context.Context, state *ParserState, fetch FetchSpec, uri string) (string, error) {
+	ttl := time.Duration(fetch.CacheTTL)
+	key := normalizeURL(uri)
+	var cached *Page
+	if ttl > 0 && !state.Refresh() {
+		cached = pageCache.Get(key)
+		if cached != nil && time.Since(cached.Fetched) < ttl {
+			state.SetStat("cache-hits", 1)
+			return cached.Body, nil
+		}
+	}
+	if ttl > 0 {
+		state.SetStat("cache-misses", 1)
+	}
+
+	page, err := fetchPage(ctx, state, fetch, uri, cached)
+	if err != nil {
+		return "", err
+	}
+	if page.revalidated {
+		state.SetStat("cache-revalidated", 1)
+	}
+	if ttl > 0 {
+		if err := pageCache.Put(key, page); err != nil {
+			glog.Errorln(err)
+		}
+	}
+	return page.Body, nil
+}
+
+// fetchPage fetches the page through a proxy, failed attempts are retried
+// with exponential backoff, each one through another proxy
+func fetchPage(ctx context.Context, state *ParserState, fetch FetchSpec, uri string, cached *Page) (*Page, error) {
+	limiter, err := hostLimiters.Get(uri, fetch)
+	if err != nil {
+		return nil, err
+	}
+	if !fetch.IgnoreRobots {
+		if err := checkRobots(ctx, uri, limiter); err != nil {
+			return nil, err
+		}
+	}
+
+	var lastProxy string
+	for attempt := 0; ; attempt++ {
+		waitStarted := time.Now()
+		release, err := limiter.Wait(ctx)
+		if err != nil {
+			return nil, err
+		}
+		state.SetStat("rate-limit-wait-ms", int(time.Since(waitStarted)/time.Millisecond))
+
+		proxy, err := getOtherProxy(ctx, lastProxy)
+		if err != nil {
+			release()
+			state.SetStat("proxy-timeouts", 1)
+			return nil, err
+		}
+		lastProxy = proxy
+
+		state.SetStat("request-attempts", 1)
+		started := time.Now()
+		var page *Page
+		var retryAfter time.Duration
+		session, err := openSession(state, uri, proxy, fetch)
+		if err == nil {
+			page, retryAfter, err = getPageOnce(uri, session, cached)
+			if reason := fetch.Block.Detect(page.text(), err); reason != "" {
+				// the proxy is known to the shop, another one may pass
+				page, retryAfter, err = nil, 0, &BlockedError{uri, reason}
+				state.SetStat("blocked", 1)
+			}
+			if fetch.Session != nil && isBlocked(err) {
+				sessions.Renew(session)
+				state.SetStat("session-renewals", 1)
+			}
+		}
+		release()
+		if retryAfter < 0 {
+			// the page itself is wrong, the proxy did its job
+			ReleaseProxy(proxy, time.Since(started), nil)
+		} else {
+			ReleaseProxy(proxy, time.Since(started), err)
+		}
+		if err == nil {
+			return page, nil
+		}
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			state.SetStat("request-timeouts", 1)
+		}
+		if retryAfter < 0 || attempt >= *retries {
+			state.SetStat("request-failures", 1)
+			return nil, err
+		}
+
+		wait := backoff(attempt)
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		glog.Infoln(fmt.Sprintf("Retry %s in %v: %v", uri, wait, err))
+		state.SetStat("request-retries", 1)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// getBodyOnce makes a single request. A negative retryAfter means the
+// request should not be retried, a positive one is the delay the site asked
+// for.
+func getBodyOnce(uri string, session *Session) (string, time.Duration, error) {
+	page, retryAfter, err := getPageOnce(uri, session, nil)
+	if err != nil {
+		return "", retryAfter, err
+	}
+	return page.Body, retryAfter, nil
+}
+
+// getPageOnce is getBodyOnce revalidating the cached page when there is one
+func getPageOnce(uri string, session *Session, cached *Page) (*Page, time.Duration, error) {
+	header := http.Header{}
+	if cached != nil {
+		if cached.ETag != "" {
+			header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	resp, err := session.Do(uri, header)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		body, err := readBody(resp, session.Fetch)
+		if err == errBodyTooLarge {
+			return nil, -1, fmt.Errorf("%s is over %d bytes", uri, session.Fetch.MaxBodySize)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		page := &Page{
+			URL:          uri,
+			Body:         body,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			Fetched:      time.Now(),
+		}
+		return page, 0, nil
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		page := *cached
+		page.Fetched = time.Now()
+		page.revalidated = true
+		return &page, 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode == http.StatusServiceUnavailable:
+		retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+		return nil, retryAfter, newStatusError(resp, uri, session.Fetch)
+	case resp.StatusCode >= 500:
+		return nil, 0, newStatusError(resp, uri, session.Fetch)
+	default:
+		return nil, -1, newStatusError(resp, uri, session.Fetch)
+	}
+}
+
+// StatusError is a response with a status other than 200, redirects are
+// not followed and keep their Location
+type StatusError struct {
+	Code     int
+	URI      string
+	Location string
+	// for block detection
+	body string
+}
+
+func newStatusError(resp *http.Response, uri string, fetch FetchSpec) *StatusError {
+	// a body too large or broken is not a block page we know of
+	body, _ := readBody(resp, fetch)
+	return &StatusError{resp.StatusCode, uri, resp.Header.Get("Location"), body}
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%v - %s", e.Code, e.URI)
+}
+
+var errBodyTooLarge = errors.New("body too large")
+
+// readBody decodes the body, Go does not do it for us once Accept-Encoding
+// is set by the request. The decoded body is capped at the shop max size
+// and converted to UTF-8.
+func readBody(resp *http.Response, fetch FetchSpec) (string, error) {
+	var r io.Reader = resp.Body
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return "", err
+		}
+		defer gz.Close()
+		r = gz
+	case "deflate":
+		zr, err := zlib.NewReader(resp.Body)
+		if err != nil {
+			return "", err
+		}
+		defer zr.Close()
+		r = zr
+	case "br":
+		r = brotli.NewReader(resp.Body)
+	default:
+		return "", fmt.Errorf("Unsupported Content-Encoding %s", resp.Header.Get("Content-Encoding"))
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r, fetch.MaxBodySize+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(body)) > fetch.MaxBodySize {
+		return "", errBodyTooLarge
+	}
+	return toUTF8(body, resp.Header.Get("Content-Type"), fetch.Charset)
+}
+
+// getOtherProxy avoids handing out the proxy the previous attempt failed on
+// when the pool has anything else
+func getOtherProxy(ctx context.Context, last string) (string, error) {
+	p, err := GetProxy(ctx)
+	if err != nil || p == "" || p != last || proxy.available() == 0 {
+		return p, err
+	}
+	other, err := GetProxy(ctx)
+	proxy.put(p)
+	return other, err
+}
+
+// backoff is the exponential delay before the retry with half of it random
+func backoff(attempt int) time.Duration {
+	if *retryBackoff <= 0 {
+		return 0
+	}
+	d := *retryBackoff << uint(attempt)
+	if d > *retryMaxBackoff || d <= 0 {
+		d = *retryMaxBackoff
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	var d time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		d = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		d = t.Sub(time.Now())
+	}
+	if d < 0 {
+		return 0
+	}
+	if d > *retryMaxBackoff {
+		return *retryMaxBackoff
+	}
+	return d
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	defer func(d time.Duration) { *retryBackoff = d }(*retryBackoff)
+
+	*retryBackoff = 0
+	if d := backoff(3); d != 0 {
+		t.Errorf("no backoff gave %v", d)
+	}
+
+	*retryBackoff = time.Second
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		if d := backoff(attempt); d < max/2 || d > max {
+			t.Errorf("attempt %d: %v not in [%v, %v]", attempt, d, max/2, max)
+		}
+	}
+	if d := backoff(60); d < *retryMaxBackoff/2 || d > *retryMaxBackoff {
+		t.Errorf("overflow: %v", d)
+	}
+}
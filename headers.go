@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+)
+
+var headerProfiles = HeaderProfiles{RWMutex: &sync.RWMutex{}, byProxy: map[string]*HeaderProfile{}}
+
+// HeaderProfile is the set of headers one browser sends with a page request,
+// the User-Agent must match the rest of them
+type HeaderProfile struct {
+	Name    string            `json:"name"`
+	Headers map[string]string `json:"headers"`
+}
+
+func (p *HeaderProfile) UserAgent() string {
+	return p.Headers["User-Agent"]
+}
+
+func (p *HeaderProfile) Validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("profile without name")
+	}
+	if p.UserAgent() == "" {
+		return fmt.Errorf("profile %s has no User-Agent", p.Name)
+	}
+	return nil
+}
+
+// HeaderProfiles gives each proxy its own profile, so a shop sees the same
+// browser behind the same address
+type HeaderProfiles struct {
+	*sync.RWMutex
+	profiles []*HeaderProfile
+	byProxy  map[string]*HeaderProfile
+}
+
+func LoadHeaderProfiles(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var profiles []*HeaderProfile
+	if err := json.NewDecoder(file).Decode(&profiles); err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+	if len(profiles) == 0 {
+		return fmt.Errorf("%s: no header profiles defined", fileName)
+	}
+	names := Set{}
+	for i, p := range profiles {
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("%s: profile #%d: %v", fileName, i+1, err)
+		}
+		if _, ok := names[p.Name]; ok {
+			return fmt.Errorf("%s: duplicate profile %s", fileName, p.Name)
+		}
+		names[p.Name] = struct{}{}
+	}
+
+	headerProfiles.Lock()
+	defer headerProfiles.Unlock()
+	headerProfiles.profiles = profiles
+	headerProfiles.byProxy = map[string]*HeaderProfile{}
+	return nil
+}
+
+// ForProxy returns the profile of the proxy, a random one on the first call
+func (h HeaderProfiles) ForProxy(p string) *HeaderProfile {
+	h.RLock()
+	profile, ok := h.byProxy[p]
+	h.RUnlock()
+	if ok {
+		return profile
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if profile, ok := h.byProxy[p]; ok {
+		return profile
+	}
+	profile = h.profiles[rand.Intn(len(h.profiles))]
+	h.byProxy[p] = profile
+	return profile
+}
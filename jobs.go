@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+var ErrJobCancelled = errors.New("cancelled")
+
+var jobsBucket = []byte("jobs")
+
+// While a job is running its state is the phase of the parser, see
+// Parser.Phase, the store only knows it as running
+const (
+	JobReading    = "reading"
+	JobScraping   = "scraping"
+	JobWriting    = "writing"
+	JobDelivering = "delivering"
+)
+
+type Job struct {
+	ID          uint64         `json:"id"`
+	FileName    string         `json:"fileName"`
+	CallbackURI string         `json:"callbackUri"`
+	FeedPath    string         `json:"-"`                 // made by the store from ID and FileName
+	Refresh     bool           `json:"refresh,omitempty"` // bypass the page cache
+	State       string         `json:"state"`
+	Stats       map[string]int `json:"stats,omitempty"`
+	Error       string         `json:"error,omitempty"`
+	Created     time.Time      `json:"created"`
+	Started     *time.Time     `json:"started,omitempty"`
+	Finished    *time.Time     `json:"finished,omitempty"`
+	Updated     time.Time      `json:"updated"`
+}
+
+func (j *Job) IsFinished() bool {
+	return j.State == JobDone || j.State == JobFailed || j.State == JobCancelled
+}
+
+// JobCancels holds cancel functions of the jobs taken by parsers
+type JobCancels struct {
+	*sync.Mutex
+	funcs map[uint64]context.CancelFunc
+}
+
+func (c JobCancels) Add(id uint64, cancel context.CancelFunc) {
+	c.Lock()
+	defer c.Unlock()
+	c.funcs[id] = cancel
+}
+
+func (c JobCancels) Remove(id uint64) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.funcs, id)
+}
+
+func (c JobCancels) Cancel(id uint64) bool {
+	c.Lock()
+	defer c.Unlock()
+	cancel, ok := c.funcs[id]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+func (j *Job) Feed() Feed {
+	return Feed{
+		jobID:       j.ID,
+		feedPath:    j.FeedPath,
+		callbackURI: j.CallbackURI,
+		fileName:    j.FileName,
+		refresh:     j.Refresh,
+	}
+}
+
+// JobStore keeps jobs in a bolt database so that queued and interrupted
+// feeds can be picked up again after a restart
+type JobStore struct {
+	db      *bolt.DB
+	feedDir string
+}
+
+func OpenJobStore(dir string) (*JobStore, error) {
+	feedDir := filepath.Join(dir, "feeds")
+	if err := os.MkdirAll(feedDir, 0755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(dir, "jobs.db"), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(jobsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &JobStore{db, feedDir}, nil
+}
+
+func (s *JobStore) Close() error {
+	return s.db.Close()
+}
+
+// Create stores the uploaded feed on disk and registers a queued job for it
+func (s *JobStore) Create(fileName, callbackURI string, refresh bool, feed io.Reader) (*Job, error) {
+	job := &Job{
+		FileName:    fileName,
+		CallbackURI: callbackURI,
+		Refresh:     refresh,
+		State:       JobQueued,
+		Created:     time.Now(),
+	}
+	// the feed is copied outside of the transactions, they lock the store
+	// for running jobs too
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		id, err := tx.Bucket(jobsBucket).NextSequence()
+		job.ID = id
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	job.FeedPath = s.feedPath(job)
+	if err := writeFeedFile(job.FeedPath, feed); err != nil {
+		return nil, err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return putJob(tx, job)
+	})
+	if err != nil {
+		os.Remove(job.FeedPath)
+		return nil, err
+	}
+	return job, nil
+}
+
+func (s *JobStore) Get(id uint64) (*Job, error) {
+	var job *Job
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(jobsBucket).Get(jobKey(id))
+		if v == nil {
+			return nil
+		}
+		job = &Job{}
+		return s.decodeJob(v, job)
+	})
+	return job, err
+}
+
+func (s *JobStore) Update(id uint64, update func(*Job)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		v := tx.Bucket(jobsBucket).Get(jobKey(id))
+		if v == nil {
+			return fmt.Errorf("No job %d", id)
+		}
+		var job Job
+		if err := s.decodeJob(v, &job); err != nil {
+			return err
+		}
+		update(&job)
+		if job.IsFinished() {
+			os.Remove(job.FeedPath)
+			err := tx.DeleteBucket(checkpointBucket(id))
+			if err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return putJob(tx, &job)
+	})
+}
+
+func (s *JobStore) Start(id uint64) error {
+	return s.Update(id, func(job *Job) {
+		now := time.Now()
+		job.State = JobRunning
+		job.Started = &now
+	})
+}
+
+// Finish tells if this call finished the job, a job finished already is
+// left as it is
+func (s *JobStore) Finish(id uint64, stats map[string]int, err error) (bool, error) {
+	finished := false
+	updateErr := s.Update(id, func(job *Job) {
+		if job.IsFinished() {
+			return
+		}
+		finished = true
+		now := time.Now()
+		job.State = JobDone
+		job.Stats = stats
+		job.Finished = &now
+		if err == ErrJobCancelled {
+			job.State = JobCancelled
+		} else if err != nil {
+			job.State = JobFailed
+			job.Error = err.Error()
+		}
+	})
+	return finished, updateErr
+}
+
+// Pending returns queued and interrupted jobs, oldest first. Interrupted
+// jobs are put back to the queue.
+func (s *JobStore) Pending() ([]*Job, error) {
+	var jobs []*Job
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(jobsBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			job := &Job{}
+			if err := s.decodeJob(v, job); err != nil {
+				return err
+			}
+			if job.State == JobQueued || job.State == JobRunning {
+				jobs = append(jobs, job)
+			}
+		}
+		for _, job := range jobs {
+			job.State = JobQueued
+			job.Started = nil
+			if err := putJob(tx, job); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return jobs, err
+}
+
+// decodeJob reads a stored job, its feed path is not stored so that it is
+// not shown to the clients
+func (s *JobStore) decodeJob(v []byte, job *Job) error {
+	if err := json.Unmarshal(v, job); err != nil {
+		return err
+	}
+	job.FeedPath = s.feedPath(job)
+	return nil
+}
+
+func (s *JobStore) feedPath(job *Job) string {
+	return filepath.Join(s.feedDir, fmt.Sprintf("%d-%s", job.ID, filepath.Base(job.FileName)))
+}
+
+func putJob(tx *bolt.Tx, job *Job) error {
+	job.Updated = time.Now()
+	v, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(jobsBucket).Put(jobKey(job.ID), v)
+}
+
+func jobKey(id uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, id)
+	return b
+}
+
+func writeFeedFile(path string, feed io.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, feed); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
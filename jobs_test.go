@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestJobStoreFeedPath(t *testing.T) {
+	store, err := OpenJobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	job, err := store.Create("go.xml", "http://portal/cb", false, strings.NewReader("<feed/>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := json.Marshal(job)
+	if strings.Contains(string(out), store.feedDir) {
+		t.Errorf("feed path is shown to clients: %s", out)
+	}
+
+	stored, err := store.Get(job.ID)
+	if err != nil || stored == nil {
+		t.Fatalf("Get: %v, %v", stored, err)
+	}
+	if stored.FeedPath != job.FeedPath {
+		t.Errorf("feed path %q, want %q", stored.FeedPath, job.FeedPath)
+	}
+	if _, err := os.Stat(stored.FeedPath); err != nil {
+		t.Error(err)
+	}
+
+	if finished, err := store.Finish(job.ID, nil, nil); err != nil || !finished {
+		t.Fatalf("Finish: %v, %v", finished, err)
+	}
+	if finished, err := store.Finish(job.ID, nil, ErrJobCancelled); err != nil || finished {
+		t.Fatalf("second Finish: %v, %v", finished, err)
+	}
+	if stored, _ := store.Get(job.ID); stored.State != JobDone {
+		t.Errorf("state %s, want %s", stored.State, JobDone)
+	}
+	if _, err := os.Stat(job.FeedPath); !os.IsNotExist(err) {
+		t.Errorf("feed of a finished job is kept: %v", err)
+	}
+}
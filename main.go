@@ -4,7 +4,11 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
-	"strings"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/context"
@@ -18,21 +22,41 @@ import (
 type Set map[string]struct{}
 
 var (
-	po ParserOverseer
-
-	host           = flag.String("host", "localhost:8001", "host address")
-	proxyFile      = flag.String("proxyFile", "proxy.txt", "file with proxies")
-	scrappersCount = flag.Int("scrappers", 100, "count of concurrent scrappers per parser")
-	urlLimit       = flag.Int("url_limit", -1, "specify to limit the number of processed xml rows")
-	parsersCount   = flag.Int("parsers", 1, "count of concurrent parsers")
-	writeToFile    = flag.Bool("file", false, "flush result to file instead of sending to portal")
-
-	availableParsers = Set{
-		"shopart":  struct{}{},
-		"eldorado": struct{}{},
-		"go":       struct{}{},
-		"fotos":    struct{}{},
-	}
+	po            ParserOverseer
+	proxyProvider ProxyProvider
+
+	host             = flag.String("host", "localhost:8001", "host address")
+	proxyFile        = flag.String("proxyFile", "proxy.txt", "file with proxies")
+	proxyURL         = flag.String("proxyUrl", "", "url to download the proxy list from instead of the file")
+	proxyCommand     = flag.String("proxyCommand", "", "shell command printing the proxy list, used instead of the file")
+	proxyRefresh     = flag.Duration("proxyRefresh", 0, "how often to reload the proxy list, 0 to load it once")
+	direct           = flag.Bool("direct", false, "connect to shops directly, without proxies")
+	proxyWait        = flag.Duration("proxyWait", time.Minute, "how long a scrapper waits for a free proxy")
+	scrappersCount   = flag.Int("scrappers", 100, "count of concurrent scrappers per parser")
+	hostRps          = flag.Float64("hostRps", 5, "requests per second to a shop host, unless the shop sets it")
+	hostConcurrency  = flag.Int("hostConcurrency", 10, "concurrent requests to a shop host, unless the shop sets it")
+	robotsTTL        = flag.Duration("robotsTtl", 24*time.Hour, "how long robots.txt of a shop is cached")
+	connectTimeout   = flag.Duration("connectTimeout", 10*time.Second, "timeout of connecting to a shop or a proxy, unless the shop sets it")
+	headerTimeout    = flag.Duration("headerTimeout", 20*time.Second, "timeout of waiting for the response headers, unless the shop sets it")
+	fetchTimeout     = flag.Duration("fetchTimeout", time.Minute, "timeout of a whole page request, unless the shop sets it")
+	maxBodySize      = flag.Int64("maxBodySize", 10<<20, "max size of a page in bytes, unless the shop sets it")
+	defaultCharset   = flag.String("charset", "windows-1251", "charset of pages that do not declare it, unless the shop sets it")
+	cacheTTL         = flag.Duration("cacheTtl", 6*time.Hour, "how long fetched pages are cached, unless the shop sets it, 0 to not cache")
+	offerMaxAge      = flag.Duration("offerMaxAge", 7*24*time.Hour, "how long an unchanged offer is taken from the last run instead of the shop, 0 to scrape every offer")
+	record           = flag.String("record", "", "directory to save every fetched page to")
+	replay           = flag.String("replay", "", "directory of recorded pages to serve instead of the shops")
+	urlLimit         = flag.Int("url_limit", -1, "specify to limit the number of processed xml rows")
+	parsersCount     = flag.Int("parsers", 1, "count of concurrent parsers")
+	writeToFile      = flag.Bool("file", false, "flush result to file instead of sending to portal")
+	shopsFile        = flag.String("shopsFile", "shops.json", "file with shop definitions")
+	headersFile      = flag.String("headersFile", "headers.json", "file with browser header profiles")
+	dataDir          = flag.String("dataDir", "data", "directory for uploaded feeds and the job store")
+	retries          = flag.Int("retries", 3, "how many times a failed product page is retried")
+	retryBackoff     = flag.Duration("retryBackoff", time.Second, "delay before the first retry, doubled on each next one")
+	retryMaxBackoff  = flag.Duration("retryMaxBackoff", 30*time.Second, "max delay between retries")
+	proxyMaxFailures = flag.Int("proxyMaxFailures", 3, "failures in a row after which a proxy is quarantined")
+	proxyCooldown    = flag.Duration("proxyCooldown", 5*time.Minute, "how long a quarantined proxy rests before the check")
+	proxyCheckURL    = flag.String("proxyCheckUrl", "http://www.google.com/", "page a quarantined proxy must load to come back, empty to skip the check")
 )
 
 func addParseJob(c *echo.Context) error {
@@ -44,9 +68,14 @@ func addParseJob(c *echo.Context) error {
 
 	callback := c.Form("callbackUri")
 	fileName := header.Filename
+	refresh := false
+	if v := c.Form("refresh"); v != "" {
+		if refresh, err = strconv.ParseBool(v); err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Bad refresh - %s", v))
+		}
+	}
 
-	shopID := strings.Split(fileName, ".")[0]
-	if _, ok := availableParsers[shopID]; !ok {
+	if _, ok := shopRegistry.ForFile(fileName); !ok {
 		msg := fmt.Sprintf("There is no parser for file - %s", fileName)
 		return c.String(http.StatusBadRequest, msg)
 	}
@@ -58,25 +87,149 @@ func addParseJob(c *echo.Context) error {
 			return c.String(http.StatusBadRequest, msg)
 		}
 	}
-	po.feedC <- Feed{file, callback, fileName}
-	return nil
+
+	defer file.Close()
+	job, err := po.jobStore.Create(fileName, callback, refresh, file)
+	if err != nil {
+		glog.Errorln(err)
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	po.feedC <- job.Feed()
+	return c.JSON(http.StatusOK, job)
 }
 
 func stats(c *echo.Context) error {
 	return c.JSON(http.StatusOK, po.GetStats())
 }
 
+func jobStatus(c *echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	job, err := po.JobStatus(id)
+	if err != nil {
+		glog.Errorln(err)
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	if job == nil {
+		msg := fmt.Sprintf("There is no job - %d", id)
+		return c.String(http.StatusNotFound, msg)
+	}
+	return c.JSON(http.StatusOK, job)
+}
+
+func cancelJob(c *echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	job, err := po.CancelJob(id)
+	if err != nil {
+		return c.String(http.StatusConflict, err.Error())
+	}
+	if job == nil {
+		msg := fmt.Sprintf("There is no job - %d", id)
+		return c.String(http.StatusNotFound, msg)
+	}
+	return c.JSON(http.StatusOK, job)
+}
+
+func listProxies(c *echo.Context) error {
+	return c.JSON(http.StatusOK, ProxiesHealth())
+}
+
+func reloadProxies(c *echo.Context) error {
+	if *direct {
+		return c.String(http.StatusBadRequest, "Direct mode, there are no proxies")
+	}
+	if *replay != "" {
+		return c.String(http.StatusBadRequest, "Replay mode, there are no proxies")
+	}
+	if err := LoadProxies(proxyProvider); err != nil {
+		glog.Errorln(err)
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(http.StatusOK, ProxiesHealth())
+}
+
+// reloadProxiesOnSignal reloads the proxy list on SIGHUP
+func reloadProxiesOnSignal() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			if err := LoadProxies(proxyProvider); err != nil {
+				glog.Errorln(err)
+			} else {
+				glog.Infoln("Proxies reloaded")
+			}
+		}
+	}()
+}
+
+func listShops(c *echo.Context) error {
+	return c.JSON(http.StatusOK, shopRegistry.List())
+}
+
 func main() {
 	flag.Parse()
 
-	LoadProxies(*proxyFile)
+	if err := LoadShops(*shopsFile, shopRegistry); err != nil {
+		glog.Fatalln(err)
+	}
+	if err := LoadHeaderProfiles(*headersFile); err != nil {
+		glog.Fatalln(err)
+	}
+	var err error
+	switch {
+	case *record != "" && *replay != "":
+		glog.Fatalln("-record and -replay can not be used together")
+	case *record != "":
+		glog.Infoln(fmt.Sprintf("Recording pages to %s", *record))
+		archive, err = OpenArchive(*record)
+	case *replay != "":
+		glog.Infoln(fmt.Sprintf("Replaying pages from %s, no requests are made", *replay))
+		archive, err = OpenArchive(*replay)
+	}
+	if err != nil {
+		glog.Fatalln(err)
+	}
+
+	switch {
+	case *replay != "":
+	case *direct:
+		glog.Infoln("Direct mode, shops are scraped without proxies")
+	default:
+		proxyProvider = NewProxyProvider()
+		if err := LoadProxies(proxyProvider); err != nil {
+			glog.Fatalln(err)
+		}
+		reloadProxiesOnSignal()
+		if *proxyRefresh > 0 {
+			RefreshProxies(proxyProvider, *proxyRefresh)
+		}
+	}
+
+	jobStore, err := OpenJobStore(*dataDir)
+	if err != nil {
+		glog.Fatalln(err)
+	}
+	defer jobStore.Close()
+	if pageCache, err = OpenPageCache(filepath.Join(*dataDir, "cache")); err != nil {
+		glog.Fatalln(err)
+	}
 
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	po = ParserOverseer{
 		parsersCount:   *parsersCount,
 		scrappersCount: *scrappersCount,
+		jobStore:       jobStore,
 	}
 	po.Start(ctx)
+	if err := po.Resume(); err != nil {
+		glog.Errorln(err)
+	}
 
 	e := echo.New()
 	e.SetDebug(true)
@@ -85,7 +238,12 @@ func main() {
 	e.Use(mw.Recover())
 
 	e.Get("/stats", stats)
+	e.Get("/shops", listShops)
+	e.Get("/proxies", listProxies)
+	e.Post("/proxies/reload", reloadProxies)
 	e.Post("/parse", addParseJob)
+	e.Get("/jobs/:id", jobStatus)
+	e.Delete("/jobs/:id", cancelJob)
 
 	glog.Errorln(graceful.ListenAndServe(e.Server(*host), 5*time.Second))
 	cancelFunc()
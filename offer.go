@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+type OfferField struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Value   string     `xml:",innerxml"`
+}
+
+// Offer is a feed item of any shop, only the attrs and fields listed in the
+// shop definition are written back
+type Offer struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr   `xml:",any,attr"`
+	Fields  []OfferField `xml:",any"`
+
+	Attributes []Attribute
+
+	shop *Shop
+}
+
+func (o *Offer) Attr(name string) string {
+	for _, a := range o.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func (o *Offer) SetAttr(name, value string) {
+	for i, a := range o.Attrs {
+		if a.Name.Local == name {
+			o.Attrs[i].Value = value
+			return
+		}
+	}
+	o.Attrs = append(o.Attrs, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+}
+
+// Text returns the character data of the field with entities and CDATA
+// sections resolved
+func (f OfferField) Text() string {
+	var v struct {
+		Text string `xml:",chardata"`
+	}
+	if err := xml.Unmarshal([]byte("<v>"+f.Value+"</v>"), &v); err != nil {
+		return f.Value
+	}
+	return v.Text
+}
+
+func (o *Offer) Field(name string) string {
+	for _, f := range o.Fields {
+		if f.XMLName.Local == name {
+			return f.Text()
+		}
+	}
+	return ""
+}
+
+func (o *Offer) SetField(name, text string) {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(text))
+	for i, f := range o.Fields {
+		if f.XMLName.Local == name {
+			o.Fields[i].Value = b.String()
+			return
+		}
+	}
+	field := OfferField{XMLName: xml.Name{Local: name}, Value: b.String()}
+	o.Fields = append(o.Fields, field)
+}
+
+func (o *Offer) RemoveField(name string) {
+	fields := o.Fields[:0]
+	for _, f := range o.Fields {
+		if f.XMLName.Local != name {
+			fields = append(fields, f)
+		}
+	}
+	o.Fields = fields
+}
+
+func (o *Offer) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{Local: o.shop.Names["item"]}}
+	for _, name := range o.shop.Offer.Attrs {
+		for _, a := range o.Attrs {
+			if a.Name.Local == name {
+				start.Attr = append(start.Attr, xml.Attr{Name: a.Name, Value: a.Value})
+				break
+			}
+		}
+	}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+
+	for _, name := range o.shop.Offer.Fields {
+		for _, f := range o.Fields {
+			if f.XMLName.Local != name {
+				continue
+			}
+			// the attributes come from f.Attrs
+			fStart := xml.StartElement{Name: xml.Name{Local: name}}
+			f.XMLName = fStart.Name
+			if err := e.EncodeElement(f, fStart); err != nil {
+				return err
+			}
+		}
+	}
+	for _, a := range o.Attributes {
+		if err := e.Encode(a); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// SourceHash identifies the offer as it came in the feed together with the
+// shop names, output and extractor specs, so a changed spec scrapes the
+// offer again. It must be taken before GetProductInfo changes the offer.
+func (o *Offer) SourceHash() string {
+	h := sha1.New()
+	spec, _ := json.Marshal([]interface{}{o.shop.Names, o.shop.Offer, o.shop.Extractor})
+	h.Write(spec)
+	for _, a := range o.Attrs {
+		fmt.Fprintf(h, "\n%s=%q", a.Name.Local, a.Value)
+	}
+	for _, f := range o.Fields {
+		fmt.Fprintf(h, "\n%s %v=%q", f.XMLName.Local, f.Attrs, f.Value)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (o *Offer) ProductID() string {
+	return o.Attr("id")
+}
+
+func (o *Offer) GetProductInfo(ctx context.Context, state *ParserState) (interface{}, error) {
+	spec := o.shop.Extractor
+
+	uri := strings.TrimSpace(o.Field(o.shop.UrlField))
+	if spec.StripQuery {
+		uri = strings.Split(uri, "?")[0]
+	}
+	body, err := GetBody(ctx, state, o.shop.Fetch, uri)
+	if err != nil {
+		return nil, err
+	}
+	bodyReader := strings.NewReader(body)
+	doc, err := goquery.NewDocumentFromReader(bodyReader)
+	if err != nil {
+		return nil, err
+	}
+
+	if spec.Required != nil && spec.Required.Text(doc.Selection) == "" {
+		return nil, fmt.Errorf("No info %s", uri)
+	}
+	if spec.StripQuery {
+		o.SetField(o.shop.UrlField, uri)
+	}
+
+	for field, selector := range spec.Fields {
+		o.SetField(field, selector.Text(doc.Selection))
+	}
+
+	if a := spec.Attributes; a != nil {
+		attributeHandler := func(i int, s *goquery.Selection) {
+			name := strings.TrimSuffix(a.Name.Text(s), a.TrimSuffix)
+			if name == "" {
+				return
+			}
+			value := a.Value.Text(s)
+			if a.MaxValueLength > 0 && len(value) >= a.MaxValueLength {
+				return
+			}
+			o.Attributes = append(o.Attributes, Attribute{Name: name, Value: value})
+		}
+		doc.Find(a.Rows).Each(attributeHandler)
+	}
+
+	if a := spec.Availability; a != nil {
+		if o.Field(a.Field) == a.Value {
+			o.SetAttr("available", "true")
+		} else {
+			o.SetAttr("available", "false")
+		}
+		o.RemoveField(a.Field)
+	}
+
+	return o, nil
+}
+
+func (s Selector) Text(selection *goquery.Selection) string {
+	found := selection.Find(s.Query)
+	if s.Last {
+		return found.Last().Text()
+	}
+	return found.First().Text()
+}
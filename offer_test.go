@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+)
+
+// roundTrip decodes the feed item the way XMLParse does and marshals it
+// back the way the writer does
+func roundTrip(t *testing.T, shopID, item string) string {
+	registry := NewShopRegistry()
+	if err := LoadShops("shops.json", registry); err != nil {
+		t.Fatal(err)
+	}
+	shop, ok := registry.Get(shopID)
+	if !ok {
+		t.Fatalf("no shop %s", shopID)
+	}
+
+	d := xml.NewDecoder(strings.NewReader(item))
+	token, err := d.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := token.(xml.StartElement)
+	offer := shop.NewExtractor()
+	if err := d.DecodeElement(offer, &start); err != nil {
+		t.Fatal(err)
+	}
+	out, err := xml.Marshal(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the output must be well-formed
+	d = xml.NewDecoder(bytes.NewReader(out))
+	for {
+		if _, err := d.Token(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("%s: %v", out, err)
+		}
+	}
+	return string(out)
+}
+
+func TestOfferRoundTripYML(t *testing.T) {
+	item := `<offer id="12" available="true" bid="5" extra="x">` +
+		`<url>http://shop.ua/p/12</url>` +
+		`<price currency="UAH">10</price>` +
+		`<name>A &amp; B</name>` +
+		`<unknown>dropped</unknown>` +
+		`</offer>`
+	want := `<offer id="12" available="true" bid="5">` +
+		`<url>http://shop.ua/p/12</url>` +
+		`<price currency="UAH">10</price>` +
+		`<name>A &amp; B</name>` +
+		`</offer>`
+	if got := roundTrip(t, "shopart", item); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestOfferRoundTripFotos(t *testing.T) {
+	item := `<item id="7" available="Склад">` +
+		`<name><![CDATA[Фото <b>камера</b>]]></name>` +
+		`<url>http://fotos.ua/7</url>` +
+		`<priceuah currency="UAH">1500</priceuah>` +
+		`<categoryId>3</categoryId>` +
+		`</item>`
+	want := `<item id="7" available="Склад">` +
+		`<name><![CDATA[Фото <b>камера</b>]]></name>` +
+		`<url>http://fotos.ua/7</url>` +
+		`<priceuah currency="UAH">1500</priceuah>` +
+		`<categoryId>3</categoryId>` +
+		`</item>`
+	if got := roundTrip(t, "fotos", item); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestSourceHashFollowsShopSpec(t *testing.T) {
+	item := `<offer id="1"><name>A</name><price>10</price></offer>`
+	hash := func(shop *Shop) string {
+		offer := &Offer{shop: shop}
+		if err := xml.Unmarshal([]byte(item), offer); err != nil {
+			t.Fatal(err)
+		}
+		return offer.SourceHash()
+	}
+	newShop := func() *Shop {
+		return &Shop{
+			ID:    "go",
+			Names: map[string]string{"item": "offer", "items": "offers"},
+			Offer: OfferSpec{Attrs: []string{"id"}, Fields: []string{"name"}},
+		}
+	}
+
+	base := hash(newShop())
+	if hash(newShop()) != base {
+		t.Fatal("hash is not stable")
+	}
+	changes := map[string]func(*Shop){
+		"field":     func(s *Shop) { s.Offer.Fields = append(s.Offer.Fields, "price") },
+		"attr":      func(s *Shop) { s.Offer.Attrs = append(s.Offer.Attrs, "available") },
+		"item name": func(s *Shop) { s.Names["item"] = "item" },
+		"extractor": func(s *Shop) { s.Extractor.StripQuery = true },
+	}
+	for name, change := range changes {
+		shop := newShop()
+		change(shop)
+		if hash(shop) == base {
+			t.Errorf("changed %s keeps the hash", name)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// OfferStore keeps the last scraped result of every offer of a shop, an
+// offer unchanged in the next feed is taken from it instead of the shop
+type OfferStore struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+type storedOffer struct {
+	// SourceHash of the offer the product was scraped for
+	Hash    string    `json:"hash"`
+	Scraped time.Time `json:"scraped"`
+	Product []byte    `json:"product"`
+}
+
+// SourceHasher is a product which can tell if its feed item changed since
+// the last run
+type SourceHasher interface {
+	SourceHash() string
+}
+
+func (s *JobStore) Offers(shopID string) (*OfferStore, error) {
+	bucket := []byte(fmt.Sprintf("offers-%s", shopID))
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &OfferStore{s.db, bucket}, nil
+}
+
+// Get returns the product scraped for the same offer not longer than
+// maxAge ago
+func (o *OfferStore) Get(offerID, hash string, maxAge time.Duration) (CheckpointedProduct, bool) {
+	var stored storedOffer
+	o.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(o.bucket)
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(offerID)); v != nil {
+			return json.Unmarshal(v, &stored)
+		}
+		return nil
+	})
+	if stored.Product == nil || stored.Hash != hash || time.Since(stored.Scraped) >= maxAge {
+		return nil, false
+	}
+	return CheckpointedProduct(stored.Product), true
+}
+
+func (o *OfferStore) Put(offerID, hash string, product interface{}) error {
+	p, err := xml.Marshal(product)
+	if err != nil {
+		return err
+	}
+	v, err := json.Marshal(storedOffer{hash, time.Now(), p})
+	if err != nil {
+		return err
+	}
+	return o.db.Batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket(o.bucket)
+		if b == nil {
+			return fmt.Errorf("No offer store %s", o.bucket)
+		}
+		return b.Put([]byte(offerID), v)
+	})
+}
@@ -1,15 +1,16 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"encoding/xml"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime/multipart"
-	"net/http"
+	"net/url"
 	"os"
-	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 
@@ -19,14 +20,18 @@ import (
 )
 
 type Feed struct {
-	file        multipart.File
+	jobID       uint64
+	feedPath    string
 	callbackURI string
 	fileName    string
+	refresh     bool
 }
 
 type ParserState struct {
 	*sync.RWMutex
-	stats map[string]int
+	stats   map[string]int
+	err     error
+	refresh bool
 }
 
 func (p ParserState) GetStat(key string) int {
@@ -48,62 +53,72 @@ func (p ParserState) SetStat(key string, delta int) {
 	}
 }
 
-func (p *ParserState) CleanStats() {
+func (p *ParserState) Snapshot() map[string]int {
+	p.RLock()
+	defer p.RUnlock()
+	stats := make(map[string]int, len(p.stats))
+	for k, v := range p.stats {
+		stats[k] = v
+	}
+	return stats
+}
+
+// SetError keeps the error which made the feed fail
+func (p *ParserState) SetError(err error) {
 	p.Lock()
 	defer p.Unlock()
-	p.stats = map[string]int{}
+	p.err = err
 }
 
-type ProductExtractor interface {
-	GetProductInfo() (interface{}, error)
+func (p *ParserState) Err() error {
+	p.RLock()
+	defer p.RUnlock()
+	return p.err
 }
 
-func GetBody(uri string) (string, error) {
-	proxy := GetProxy()
-	defer ReleaseProxy(proxy)
-
-	resp, err := goreq.Request{
-		Uri:       uri,
-		UserAgent: GetUserAgent(),
-		Proxy:     proxy,
-	}.Do()
-
-	// request := gorequest.New().Get(uri).Set("UserAgent", GetUserAgent())
-	// resp, body, errs := request.Timeout(10 * time.Second).Proxy(proxy).End()
-
-	// if len(errs) != 0 {
-	// 	for _, err := range errs {
-	// 		glog.Errorln(err)
-	// 	}
-	// 	return "", errs[0]
-	// }
+// SetRefresh makes the job bypass the page cache
+func (p *ParserState) SetRefresh(refresh bool) {
+	p.Lock()
+	defer p.Unlock()
+	p.refresh = refresh
+}
 
-	if err != nil {
-		return "", err
-	}
+func (p *ParserState) Refresh() bool {
+	p.RLock()
+	defer p.RUnlock()
+	return p.refresh
+}
 
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("%v - %s", resp.StatusCode, uri)
-	}
+func (p *ParserState) CleanStats() {
+	p.Lock()
+	defer p.Unlock()
+	p.stats = map[string]int{}
+	p.err = nil
+	p.refresh = false
+}
 
-	// return body, nil
-	return resp.Body.ToString()
+type ProductExtractor interface {
+	// ProductID identifies the product within the feed
+	ProductID() string
+	GetProductInfo(context.Context, *ParserState) (interface{}, error)
 }
 
 type Scrapper struct {
 	id                   int
+	waitGroup            *sync.WaitGroup
 	productExtractorChan <-chan ProductExtractor
 	productChan          chan<- interface{}
 	parserState          *ParserState
 }
 
-func (s Scrapper) Scrap(ctx context.Context) {
+func (s Scrapper) Scrap(ctx context.Context, checkpoint *Checkpoint, offers *OfferStore) {
+	s.waitGroup.Add(1)
 	s.parserState.SetStat("active-scrappers", 1)
 	go func() {
 		defer func() {
 			glog.Infoln(fmt.Sprintf("Scrapper %d finished", s.id))
 			s.parserState.SetStat("active-scrappers", -1)
+			s.waitGroup.Done()
 		}()
 
 		glog.Infoln(fmt.Sprintf("Scrapper %d started", s.id))
@@ -112,19 +127,68 @@ func (s Scrapper) Scrap(ctx context.Context) {
 			case <-ctx.Done():
 				return
 			case productExtractor := <-s.productExtractorChan:
-				productInfo, err := productExtractor.GetProductInfo()
+				productInfo, source, err := s.scrapProduct(ctx, productExtractor, checkpoint, offers)
+				if err == ErrDisallowed {
+					s.parserState.SetStat("disallowed", 1)
+					continue
+				}
 				if err != nil {
 					glog.Errorln(err)
 					s.parserState.SetStat("scrapping-errors", 1)
-				} else {
-					s.productChan <- productInfo
-					s.parserState.SetStat("scrapped-success", 1)
+					continue
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case s.productChan <- productInfo:
+					s.parserState.SetStat(source, 1)
 				}
+			// the reader may finish while we wait for an offer
+			case <-time.After(100 * time.Millisecond):
 			}
 		}
 	}()
 }
 
+// scrapProduct takes the product from the checkpoint when it was already
+// scraped by an interrupted run of the job, and from the offer store when
+// the offer did not change since the last run. The stat name of where the
+// product came from is returned with it.
+func (s Scrapper) scrapProduct(ctx context.Context, productExtractor ProductExtractor,
+	checkpoint *Checkpoint, offers *OfferStore) (interface{}, string, error) {
+	id := productExtractor.ProductID()
+	if id == "" {
+		productInfo, err := productExtractor.GetProductInfo(ctx, s.parserState)
+		return productInfo, "scrapped-success", err
+	}
+	if product, ok := checkpoint.Get(id); ok {
+		return product, "restored-from-checkpoint", nil
+	}
+	var hash string
+	if h, ok := productExtractor.(SourceHasher); ok && offers != nil {
+		hash = h.SourceHash()
+		if *offerMaxAge > 0 && !s.parserState.Refresh() {
+			if product, ok := offers.Get(id, hash, *offerMaxAge); ok {
+				return product, "unchanged-offers", nil
+			}
+		}
+	}
+
+	productInfo, err := productExtractor.GetProductInfo(ctx, s.parserState)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := checkpoint.Put(id, productInfo); err != nil {
+		glog.Errorln(err)
+	}
+	if hash != "" {
+		if err := offers.Put(id, hash, productInfo); err != nil {
+			glog.Errorln(err)
+		}
+	}
+	return productInfo, "scrapped-success", nil
+}
+
 type FeedParser interface {
 	ParseFeed(context.Context, multipart.File)
 }
@@ -133,6 +197,7 @@ type FeedWriter struct {
 	waitGroup       *sync.WaitGroup
 	productChan     <-chan interface{}
 	startTokensChan chan xml.Token
+	endTokensChan   chan xml.Token
 	parserState     *ParserState
 }
 
@@ -141,30 +206,62 @@ func (f FeedWriter) WriteFeed(ctx context.Context, fileName, callbackURI string)
 	f.parserState.SetStat("writing-feed", 1)
 
 	go func() {
-		var tBuffer bytes.Buffer
-		_, err := tBuffer.Write([]byte(xml.Header))
-		if err != nil {
-			panic(err)
-		}
-
-		enc := xml.NewEncoder(&tBuffer)
-		enc.Indent("", "  ")
-
 		defer func() {
 			glog.Infoln("Feed writer finished")
 			f.parserState.SetStat("writing-feed", -1)
 			f.waitGroup.Done()
 		}()
 
+		// The feed goes to a temp file, so memory does not grow with it
+		tFile, err := ioutil.TempFile("", "feed-")
+		if err != nil {
+			glog.Errorln(err)
+			f.parserState.SetError(err)
+			return
+		}
+		defer func() {
+			tFile.Close()
+			os.Remove(tFile.Name())
+		}()
+
+		tBuffer := bufio.NewWriter(tFile)
+		if _, err := tBuffer.WriteString(xml.Header); err != nil {
+			glog.Errorln(err)
+		}
+
+		enc := xml.NewEncoder(tBuffer)
+		enc.Indent("", "  ")
+		// Elements opened by forwarded tokens and not closed yet
+		var openElements []xml.Name
+		var endTokens []xml.Token
+		encodeToken := func(token xml.Token) {
+			switch t := token.(type) {
+			case xml.StartElement:
+				openElements = append(openElements, t.Name)
+			case xml.EndElement:
+				if len(openElements) != 0 {
+					openElements = openElements[:len(openElements)-1]
+				}
+			}
+			if err := enc.EncodeToken(token); err != nil {
+				glog.Errorln(err)
+			}
+		}
+
 		for f.parserState.GetStat("active-scrappers") != 0 || len(f.productChan) != 0 {
 			select {
 			case <-ctx.Done():
 				return
 			case token := <-f.startTokensChan:
-				if err := enc.EncodeToken(token); err != nil {
-					glog.Errorln(err)
-				}
+				encodeToken(token)
+			case token := <-f.endTokensChan:
+				// held until all offers are written
+				endTokens = append(endTokens, token)
 			case product := <-f.productChan:
+				// Tokens before the offer were sent before the offer itself
+				for len(f.startTokensChan) != 0 {
+					encodeToken(<-f.startTokensChan)
+				}
 				if err := enc.Encode(product); err != nil {
 					glog.Errorln(err)
 				}
@@ -173,17 +270,43 @@ func (f FeedWriter) WriteFeed(ctx context.Context, fileName, callbackURI string)
 			}
 		}
 
-		enc.Flush()
-
-		_, err = tBuffer.Write([]byte("</offers></shop></yml_catalog>"))
+		// The reader is done by now, whatever it forwarded is in the channel
+		for len(f.startTokensChan) != 0 {
+			encodeToken(<-f.startTokensChan)
+		}
+		for len(f.endTokensChan) != 0 {
+			endTokens = append(endTokens, <-f.endTokensChan)
+		}
+		for _, token := range endTokens {
+			encodeToken(token)
+		}
+		// The feed may be cut by url_limit or be broken
+		for i := len(openElements) - 1; i >= 0; i-- {
+			encodeToken(xml.EndElement{Name: openElements[i]})
+		}
+		err = enc.Flush()
+		if err == nil {
+			err = tBuffer.Flush()
+		}
+		if err == nil {
+			_, err = tFile.Seek(0, 0)
+		}
 		if err != nil {
 			glog.Errorln(err)
+			f.parserState.SetError(err)
+			return
 		}
-		// glog.Infoln(tBuffer.String())
+
+		f.parserState.SetStat("delivering-feed", 1)
+		defer f.parserState.SetStat("delivering-feed", -1)
 		if *writeToFile {
-			writeFile(fileName, &tBuffer)
+			err = writeFile(fileName, tFile)
 		} else {
-			sendFile(fileName, callbackURI, &tBuffer)
+			err = sendFile(fileName, callbackURI, tFile)
+		}
+		if err != nil {
+			glog.Errorln(err)
+			f.parserState.SetError(err)
 		}
 	}()
 }
@@ -194,12 +317,14 @@ type FeedReader struct {
 	productExtractorChan chan ProductExtractor
 	parserState          *ParserState
 	startTokensChan      chan xml.Token
+	endTokensChan        chan xml.Token
 }
 
 type Parser struct {
 	ctx                 context.Context
 	feedWriterWaitGroup *sync.WaitGroup
 	feedParserWaitGroup *sync.WaitGroup
+	scrappersWaitGroup  *sync.WaitGroup
 
 	scrappersPool  []Scrapper
 	scrappersCount int
@@ -208,14 +333,18 @@ type Parser struct {
 	feedWriter           FeedWriter
 	productExtractorChan chan ProductExtractor
 	readyParsersChan     chan *Parser
+	jobStore             *JobStore
+	jobCancels           JobCancels
 	state                *ParserState
 	fileName             string
+	jobID                uint64
 }
 
 func (p *Parser) Init() {
-	p.state = &ParserState{&sync.RWMutex{}, map[string]int{}}
+	p.state = &ParserState{RWMutex: &sync.RWMutex{}, stats: map[string]int{}}
 	p.feedWriterWaitGroup = &sync.WaitGroup{}
 	p.feedParserWaitGroup = &sync.WaitGroup{}
+	p.scrappersWaitGroup = &sync.WaitGroup{}
 	p.productExtractorChan = make(chan ProductExtractor, 100)
 	productChan := make(chan interface{}, 100)
 	p.feedWriter = FeedWriter{
@@ -223,6 +352,7 @@ func (p *Parser) Init() {
 		productChan:     productChan,
 		parserState:     p.state,
 		startTokensChan: make(chan xml.Token, 10),
+		endTokensChan:   make(chan xml.Token, 10),
 	}
 
 	p.feedReader = FeedReader{
@@ -230,12 +360,14 @@ func (p *Parser) Init() {
 		waitGroup:            p.feedParserWaitGroup,
 		productExtractorChan: p.productExtractorChan,
 		startTokensChan:      p.feedWriter.startTokensChan,
+		endTokensChan:        p.feedWriter.endTokensChan,
 	}
 
 	for i := 0; i < p.scrappersCount; i++ {
 		scrapper := Scrapper{
 			parserState:          p.state,
 			id:                   i + 1,
+			waitGroup:            p.scrappersWaitGroup,
 			productExtractorChan: p.productExtractorChan,
 			productChan:          productChan,
 		}
@@ -245,34 +377,140 @@ func (p *Parser) Init() {
 
 func (p *Parser) Start(ctx context.Context, f Feed) {
 	p.fileName = f.fileName
+	p.jobID = f.jobID
 
-	shopID := strings.Split(p.fileName, ".")[0]
-	var feedParser FeedParser
-	switch shopID {
-	case "shopart":
-		feedParser = ShopArtFeedParser{p.feedReader}
-	case "eldorado":
-		feedParser = EldoradoFeedParser{p.feedReader}
-	case "go":
-		feedParser = GoFeedParser{p.feedReader}
-	case "fotos":
-		feedParser = FotosFeedParser{p.feedReader}
-	default:
-		panic(fmt.Sprintf("No parser for file %s", p.fileName))
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	p.jobCancels.Add(f.jobID, cancel)
+	defer p.jobCancels.Remove(f.jobID)
+
+	job, err := p.jobStore.Get(f.jobID)
+	if err != nil || job == nil {
+		p.fail(f, fmt.Errorf("No job %d: %v", f.jobID, err))
+		return
+	}
+	if job.IsFinished() {
+		// cancelled while it was queued, CancelJob told the callback
+		p.release()
+		return
+	}
+
+	shop, ok := shopRegistry.ForFile(p.fileName)
+	if !ok {
+		p.fail(f, fmt.Errorf("No parser for file %s", p.fileName))
+		return
+	}
+	file, err := os.Open(f.feedPath)
+	if err != nil {
+		p.fail(f, err)
+		return
+	}
+	if err := p.jobStore.Start(f.jobID); err != nil {
+		glog.Errorln(err)
+	}
+	p.state.SetRefresh(f.refresh)
+	checkpoint, err := p.jobStore.Checkpoint(f.jobID)
+	if err != nil {
+		file.Close()
+		p.fail(f, err)
+		return
+	}
+	if n := checkpoint.Count(); n != 0 {
+		glog.Infof("Job %d resumed, %d offers are in the checkpoint", f.jobID, n)
+	}
+	// replayed pages may be old, they must not pass for the last run, and a
+	// recorded job has to fetch every page to have it in the archive
+	var offers *OfferStore
+	if *replay == "" && *record == "" {
+		offers, err = p.jobStore.Offers(shop.ID)
+		if err != nil {
+			file.Close()
+			p.fail(f, err)
+			return
+		}
 	}
 
-	feedParser.ParseFeed(ctx, f.file)
-	p.feedWriter.WriteFeed(ctx, f.fileName, f.callbackURI)
+	var feedParser FeedParser = ShopFeedParser{p.feedReader, shop}
 
+	feedParser.ParseFeed(jobCtx, file)
+	// The writer stops once there are no active scrappers, so they go first
 	for _, scrapper := range p.scrappersPool {
-		scrapper.Scrap(ctx)
+		scrapper.Scrap(jobCtx, checkpoint, offers)
 	}
+	p.feedWriter.WriteFeed(jobCtx, f.fileName, f.callbackURI)
 	p.feedWriterWaitGroup.Wait()
+	p.feedParserWaitGroup.Wait()
+	p.scrappersWaitGroup.Wait()
+	p.drain()
+
+	switch {
+	case ctx.Err() != nil:
+		// Shutdown, the job stays running and is resumed on the next start
+	case jobCtx.Err() != nil:
+		glog.Infoln(fmt.Sprintf("Job %d cancelled", f.jobID))
+		// the callback is told by whoever finished the job
+		if p.finishJob(ErrJobCancelled) {
+			if err := notifyCancelled(f.fileName, f.callbackURI); err != nil {
+				glog.Errorln(err)
+			}
+		}
+	default:
+		p.finishJob(p.state.Err())
+	}
+	p.release()
+}
+
+func (p *Parser) fail(f Feed, err error) {
+	glog.Errorln(err)
+	p.finishJob(err)
+	p.release()
+}
+
+func (p *Parser) release() {
 	p.fileName = ""
+	p.jobID = 0
 	p.state.CleanStats()
 	p.readyParsersChan <- p
 }
 
+// drain throws away whatever a cancelled job left in the channels, so the
+// next feed does not get it
+func (p *Parser) drain() {
+	for {
+		select {
+		case <-p.productExtractorChan:
+		case <-p.feedWriter.productChan:
+		case <-p.feedWriter.startTokensChan:
+		case <-p.feedWriter.endTokensChan:
+		default:
+			return
+		}
+	}
+}
+
+func (p *Parser) finishJob(err error) bool {
+	finished, err := p.jobStore.Finish(p.jobID, p.state.Snapshot(), err)
+	if err != nil {
+		glog.Errorln(err)
+	}
+	return finished
+}
+
+// Phase tells what the parser is busy with, stages overlap so the
+// earliest one still in progress wins
+func (p *Parser) Phase() string {
+	switch {
+	case p.state.GetStat("reading-uri") != 0:
+		return JobReading
+	case p.state.GetStat("active-scrappers") != 0:
+		return JobScraping
+	case p.state.GetStat("delivering-feed") != 0:
+		return JobDelivering
+	default:
+		return JobWriting
+	}
+}
+
 func (p Parser) Stop() {
 	p.feedParserWaitGroup.Wait()
 	p.feedWriterWaitGroup.Wait()
@@ -284,15 +522,20 @@ type ParserOverseer struct {
 	feedC            chan Feed
 	readyParsersChan chan *Parser
 	parsersPool      []*Parser
+	jobStore         *JobStore
+	jobCancels       JobCancels
 }
 
 func (po *ParserOverseer) Start(ctx context.Context) {
 	po.readyParsersChan = make(chan *Parser, po.parsersCount)
 	po.feedC = make(chan Feed, 100)
+	po.jobCancels = JobCancels{&sync.Mutex{}, map[uint64]context.CancelFunc{}}
 	for i := 0; i < po.parsersCount; i++ {
 		p := Parser{
 			scrappersCount:   po.scrappersCount,
 			readyParsersChan: po.readyParsersChan,
+			jobStore:         po.jobStore,
+			jobCancels:       po.jobCancels,
 		}
 		p.Init()
 		po.parsersPool = append(po.parsersPool, &p)
@@ -301,6 +544,23 @@ func (po *ParserOverseer) Start(ctx context.Context) {
 	po.Listen(ctx)
 }
 
+// Resume puts jobs left over from the previous run back to the queue
+func (po *ParserOverseer) Resume() error {
+	jobs, err := po.jobStore.Pending()
+	if err != nil {
+		return err
+	}
+	if len(jobs) != 0 {
+		glog.Infof("Resuming %d jobs", len(jobs))
+	}
+	go func() {
+		for _, job := range jobs {
+			po.feedC <- job.Feed()
+		}
+	}()
+	return nil
+}
+
 func (po ParserOverseer) WaitAndStop() {
 	// We need to wait until all parser will gracefully finish
 	glog.Infof("Waiting for parsers")
@@ -329,40 +589,125 @@ type Stats map[string]map[string]int
 
 func (po ParserOverseer) GetStats() (stats []Stats) {
 	for _, p := range po.parsersPool {
-		stats = append(stats, Stats{p.fileName: p.state.stats})
+		stats = append(stats, Stats{p.fileName: p.state.Snapshot()})
 	}
 	return
 }
 
-func sendFile(fileName, callbackURI string, file io.Reader) {
-	var b bytes.Buffer
+// CancelJob stops a running job or drops a queued one
+func (po ParserOverseer) CancelJob(id uint64) (*Job, error) {
+	job, err := po.jobStore.Get(id)
+	if err != nil || job == nil {
+		return job, err
+	}
+	if job.IsFinished() {
+		return nil, fmt.Errorf("Job %d is already %s", id, job.State)
+	}
+	if po.jobCancels.Cancel(id) {
+		return job, nil
+	}
 
-	writer := multipart.NewWriter(&b)
-	part, err := writer.CreateFormFile("file", fileName)
+	finished, err := po.jobStore.Finish(id, nil, ErrJobCancelled)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	io.Copy(part, file)
-	writer.Close()
+	// it could have been picked up by a parser in the meantime, the parser
+	// leaves the job finished here as it is
+	po.jobCancels.Cancel(id)
+	if finished {
+		go func() {
+			if err := notifyCancelled(job.FileName, job.CallbackURI); err != nil {
+				glog.Errorln(err)
+			}
+		}()
+	}
+	return po.jobStore.Get(id)
+}
+
+// JobStatus returns the stored job, a running one gets the live phase and
+// counters of its parser
+func (po ParserOverseer) JobStatus(id uint64) (*Job, error) {
+	job, err := po.jobStore.Get(id)
+	if err != nil || job == nil {
+		return job, err
+	}
+	if job.State != JobRunning {
+		return job, nil
+	}
+	for _, p := range po.parsersPool {
+		if p.jobID == id {
+			job.State = p.Phase()
+			job.Stats = p.state.Snapshot()
+		}
+	}
+	return job, nil
+}
+
+// sendFile streams the feed to the portal as a chunked multipart body
+func sendFile(fileName, callbackURI string, file io.Reader) error {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	writer := multipart.NewWriter(pw)
+	go func() {
+		part, err := writer.CreateFormFile("file", fileName)
+		if err == nil {
+			_, err = io.Copy(part, file)
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		pw.CloseWithError(err)
+	}()
 
-	_, err = goreq.Request{
+	resp, err := goreq.Request{
 		Method:      "POST",
 		ContentType: writer.FormDataContentType(),
 		Uri:         callbackURI,
-		Body:        b.String(),
+		Body:        pr,
 	}.Do()
 
 	if err != nil {
-		panic(err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%v - %s", resp.StatusCode, callbackURI)
 	}
+	return nil
 }
 
-func writeFile(fileName string, file *bytes.Buffer) {
+// notifyCancelled tells the portal that the feed will not come
+func notifyCancelled(fileName, callbackURI string) error {
+	if *writeToFile {
+		return nil
+	}
+	form := url.Values{"status": {JobCancelled}, "fileName": {fileName}}
+	resp, err := goreq.Request{
+		Method:      "POST",
+		ContentType: "application/x-www-form-urlencoded",
+		Uri:         callbackURI,
+		Body:        form.Encode(),
+	}.Do()
+
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%v - %s", resp.StatusCode, callbackURI)
+	}
+	return nil
+}
+
+func writeFile(fileName string, file io.Reader) error {
 	f, err := os.Create(fileName)
 	if err != nil {
-		glog.Errorln(err)
-		return
+		return err
+	}
+	if _, err := io.Copy(f, file); err != nil {
+		f.Close()
+		return err
 	}
-	defer f.Close()
-	f.WriteString(file.String())
+	return f.Close()
 }
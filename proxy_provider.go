@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ProxyProvider is where the pool gets its proxies from
+type ProxyProvider interface {
+	fmt.Stringer
+	Proxies() ([]ProxyEntry, error)
+}
+
+// NewProxyProvider picks the provider by the flags, the file is the default
+func NewProxyProvider() ProxyProvider {
+	switch {
+	case *proxyURL != "":
+		return HTTPProxyProvider{*proxyURL}
+	case *proxyCommand != "":
+		return CommandProxyProvider{*proxyCommand}
+	default:
+		return FileProxyProvider{*proxyFile}
+	}
+}
+
+// FileProxyProvider reads the proxy list format from a file
+type FileProxyProvider struct {
+	FileName string
+}
+
+func (p FileProxyProvider) String() string {
+	return p.FileName
+}
+
+func (p FileProxyProvider) Proxies() ([]ProxyEntry, error) {
+	file, err := os.Open(p.FileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseProxyList(p, file), nil
+}
+
+// HTTPProxyProvider downloads the proxy list, e.g. from the API of the
+// proxy seller
+type HTTPProxyProvider struct {
+	URL string
+}
+
+func (p HTTPProxyProvider) String() string {
+	return redactProxy(p.URL)
+}
+
+func (p HTTPProxyProvider) Proxies() ([]ProxyEntry, error) {
+	// goreq would set the timeout on its client shared with the deliveries
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(p.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%v - %s", resp.StatusCode, p)
+	}
+	return parseProxyList(p, resp.Body), nil
+}
+
+// CommandProxyProvider runs a shell command which prints the proxy list
+type CommandProxyProvider struct {
+	Command string
+}
+
+func (p CommandProxyProvider) String() string {
+	return p.Command
+}
+
+func (p CommandProxyProvider) Proxies() ([]ProxyEntry, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("sh", "-c", p.Command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	timer := time.AfterFunc(time.Minute, func() {
+		cmd.Process.Kill()
+	})
+	defer timer.Stop()
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("%v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return parseProxyList(p, &stdout), nil
+}
+
+func parseProxyList(provider ProxyProvider, r io.Reader) []ProxyEntry {
+	entries, errs := ParseProxies(r)
+	for _, err := range errs {
+		glog.Errorln(fmt.Sprintf("%v:%v", provider, err))
+	}
+	return entries
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestQuarantineHoldsInFlightProxy(t *testing.T) {
+	defer func(n int) { *proxyMaxFailures = n }(*proxyMaxFailures)
+	*proxyMaxFailures = 1
+	p := "http://1.2.3.4:3128"
+	proxy.swap([]ProxyEntry{{URL: p, Weight: 2}})
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if got, err := GetProxy(ctx); err != nil || got != p {
+			t.Fatalf("GetProxy: %q, %v", got, err)
+		}
+	}
+	if !proxy.report(p, 0, errors.New("refused")) {
+		t.Fatal("the first failure must quarantine")
+	}
+	proxy.put(p)
+	if proxy.report(p, 0, errors.New("refused")) {
+		t.Error("a quarantined proxy is quarantined again")
+	}
+	// the other request succeeds while the proxy is in quarantine
+	ReleaseProxy(p, time.Millisecond, nil)
+
+	if n := proxy.available(); n != 0 {
+		t.Errorf("quarantined proxy is in the pool %d times", n)
+	}
+	h := ProxiesHealth()[0]
+	if !h.Quarantined || h.InUse != 0 || h.ConsecutiveFailures != 1 {
+		t.Errorf("health %+v", h)
+	}
+
+	proxy.Lock()
+	h2 := proxy.health[p]
+	h2.Quarantined = false
+	proxy.fill(p, h2)
+	proxy.Unlock()
+	if n := proxy.available(); n != 2 {
+		t.Errorf("proxy back from quarantine is in the pool %d times, want 2", n)
+	}
+}
+
+func TestSuccessKeepsProxyInPool(t *testing.T) {
+	p := "http://5.6.7.8:3128"
+	proxy.swap([]ProxyEntry{{URL: p, Weight: 1}})
+
+	got, err := GetProxy(context.Background())
+	if err != nil || got != p {
+		t.Fatalf("GetProxy: %q, %v", got, err)
+	}
+	if proxy.report(p, time.Millisecond, nil) {
+		t.Fatal("a success quarantines the proxy")
+	}
+	proxy.put(p)
+
+	got, _ = GetProxy(context.Background())
+	goroutines := runtime.NumGoroutine()
+	ReleaseProxy(got, time.Millisecond, nil)
+	if n := runtime.NumGoroutine(); n != goroutines {
+		t.Errorf("a success started %d goroutines", n-goroutines)
+	}
+	h := ProxiesHealth()[0]
+	if h.Quarantined || h.Successes != 2 || h.InUse != 0 {
+		t.Errorf("health %+v", h)
+	}
+	if n := proxy.available(); n != 1 {
+		t.Errorf("proxy is in the pool %d times, want 1", n)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var hostLimiters = HostLimiters{&sync.Mutex{}, map[string]*HostLimiter{}}
+
+// HostLimiter spaces requests to one host and caps how many of them run at
+// once
+type HostLimiter struct {
+	*sync.Mutex
+	interval time.Duration
+	next     time.Time
+	slots    chan struct{}
+}
+
+func NewHostLimiter(rps float64, concurrency int) *HostLimiter {
+	l := &HostLimiter{
+		Mutex: &sync.Mutex{},
+		slots: make(chan struct{}, concurrency),
+	}
+	if rps > 0 {
+		l.interval = time.Duration(float64(time.Second) / rps)
+	}
+	return l
+}
+
+// Wait blocks until the host may get one more request, release must be
+// called when the request is over
+func (l *HostLimiter) Wait(ctx context.Context) (release func(), err error) {
+	select {
+	case l.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	release = func() { <-l.slots }
+
+	l.Lock()
+	at := time.Now()
+	if l.next.After(at) {
+		at = l.next
+	}
+	l.next = at.Add(l.interval)
+	l.Unlock()
+
+	select {
+	case <-time.After(at.Sub(time.Now())):
+		return release, nil
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	}
+}
+
+// SetMinInterval makes the requests to the host go not more often than
+// once in d, e.g. for Crawl-delay of robots.txt
+func (l *HostLimiter) SetMinInterval(d time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	if d > l.interval {
+		l.interval = d
+	}
+}
+
+type HostLimiters struct {
+	*sync.Mutex
+	limiters map[string]*HostLimiter
+}
+
+// Get returns the limiter of the uri host, created with the shop limits on
+// the first request to the host
+func (h HostLimiters) Get(uri string, fetch FetchSpec) (*HostLimiter, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("No host in %s", uri)
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	l, ok := h.limiters[u.Host]
+	if !ok {
+		l = NewHostLimiter(fetch.RequestsPerSecond, fetch.MaxConcurrency)
+		h.limiters[u.Host] = l
+	}
+	return l, nil
+}
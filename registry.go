@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var shopRegistry = NewShopRegistry()
+
+// ShopEntry is everything a parser needs to know about a shop
+type ShopEntry struct {
+	ID           string                  `json:"id"`
+	NamesMap     map[string]string       `json:"names"`
+	Offer        string                  `json:"offer"`
+	OfferType    reflect.Type            `json:"-"`
+	NewExtractor func() ProductExtractor `json:"-"`
+}
+
+type ShopRegistry struct {
+	*sync.RWMutex
+	shops map[string]ShopEntry
+}
+
+func NewShopRegistry() *ShopRegistry {
+	return &ShopRegistry{&sync.RWMutex{}, map[string]ShopEntry{}}
+}
+
+func (r *ShopRegistry) Register(entry ShopEntry) error {
+	if entry.ID == "" {
+		return fmt.Errorf("shop without id")
+	}
+	for _, key := range namesMapKeys {
+		if entry.NamesMap[key] == "" {
+			return fmt.Errorf("%s: names map has no %q", entry.ID, key)
+		}
+	}
+	if entry.NewExtractor == nil {
+		return fmt.Errorf("%s: no extractor factory", entry.ID)
+	}
+	if entry.OfferType == nil {
+		entry.OfferType = reflect.TypeOf(entry.NewExtractor())
+	}
+	entry.Offer = entry.OfferType.String()
+
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.shops[entry.ID]; ok {
+		return fmt.Errorf("shop %s is already registered", entry.ID)
+	}
+	r.shops[entry.ID] = entry
+	return nil
+}
+
+func (r *ShopRegistry) Get(id string) (ShopEntry, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	entry, ok := r.shops[id]
+	return entry, ok
+}
+
+// ForFile finds the shop by the feed file name, e.g. eldorado.xml
+func (r *ShopRegistry) ForFile(fileName string) (ShopEntry, bool) {
+	return r.Get(strings.Split(fileName, ".")[0])
+}
+
+func (r *ShopRegistry) List() []ShopEntry {
+	r.RLock()
+	defer r.RUnlock()
+	var entries []ShopEntry
+	for _, entry := range r.shops {
+		entries = append(entries, entry)
+	}
+	sort.Sort(byShopID(entries))
+	return entries
+}
+
+type byShopID []ShopEntry
+
+func (s byShopID) Len() int           { return len(s) }
+func (s byShopID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byShopID) Less(i, j int) bool { return s[i].ID < s[j].ID }
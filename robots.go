@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/golang/glog"
+)
+
+var ErrDisallowed = errors.New("disallowed by robots.txt")
+
+var robotsCache = RobotsCache{&sync.Mutex{}, map[string]*robotsEntry{}}
+
+type robotsRule struct {
+	allow   bool
+	pattern string
+	re      *regexp.Regexp
+}
+
+// RobotsRules are the robots.txt rules for all user agents
+type RobotsRules struct {
+	rules      []robotsRule
+	CrawlDelay time.Duration
+}
+
+// ParseRobots reads the "User-agent: *" groups of robots.txt, we do not
+// introduce ourselves with a name of a bot
+func ParseRobots(r io.Reader) *RobotsRules {
+	robots := &RobotsRules{}
+	inGroup, forUs := false, false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		value := strings.TrimSpace(kv[1])
+
+		if key == "user-agent" {
+			// user agents in a row share the group
+			if !inGroup {
+				forUs = false
+			}
+			inGroup = true
+			forUs = forUs || value == "*"
+			continue
+		}
+		inGroup = false
+		if !forUs {
+			continue
+		}
+		switch key {
+		case "allow", "disallow":
+			if value != "" {
+				rule := robotsRule{key == "allow", value, robotsPattern(value)}
+				robots.rules = append(robots.rules, rule)
+			}
+		case "crawl-delay":
+			if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+				robots.CrawlDelay = time.Duration(seconds * float64(time.Second))
+			}
+		}
+	}
+	return robots
+}
+
+// Allowed checks the path with the query, the longest matching rule wins
+func (r *RobotsRules) Allowed(path string) bool {
+	allowed, longest := true, -1
+	for _, rule := range r.rules {
+		if len(rule.pattern) < longest || !rule.re.MatchString(path) {
+			continue
+		}
+		if len(rule.pattern) > longest || rule.allow {
+			allowed = rule.allow
+		}
+		longest = len(rule.pattern)
+	}
+	return allowed
+}
+
+// robotsPattern supports * for any characters and $ for the end of the path
+func robotsPattern(pattern string) *regexp.Regexp {
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = regexp.QuoteMeta(strings.TrimSuffix(pattern, "$"))
+	pattern = "^" + strings.Replace(pattern, `\*`, ".*", -1)
+	if anchored {
+		pattern += "$"
+	}
+	return regexp.MustCompile(pattern)
+}
+
+type robotsEntry struct {
+	ready   chan struct{}
+	robots  *RobotsRules
+	expires time.Time
+}
+
+// RobotsCache keeps robots.txt of each host, the first request to a host
+// fetches it and the others wait
+type RobotsCache struct {
+	*sync.Mutex
+	hosts map[string]*robotsEntry
+}
+
+func (c RobotsCache) Get(ctx context.Context, u *url.URL) (*RobotsRules, error) {
+	c.Lock()
+	e, ok := c.hosts[u.Host]
+	if ok {
+		select {
+		case <-e.ready:
+			ok = time.Now().Before(e.expires)
+		default:
+		}
+	}
+	if !ok {
+		e = &robotsEntry{ready: make(chan struct{})}
+		c.hosts[u.Host] = e
+		c.Unlock()
+
+		robotsURL := fmt.Sprintf("%s://%s/robots.txt", u.Scheme, u.Host)
+		e.robots, e.expires = fetchRobots(ctx, robotsURL)
+		close(e.ready)
+		return e.robots, nil
+	}
+	c.Unlock()
+
+	select {
+	case <-e.ready:
+		return e.robots, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fetchRobots allows everything when robots.txt is missing, when the site
+// fails to give it the answer is cached for a short time only
+func fetchRobots(ctx context.Context, robotsURL string) (*RobotsRules, time.Time) {
+	failed := time.Now().Add(10 * time.Minute)
+	proxy, err := GetProxy(ctx)
+	if err != nil {
+		glog.Errorln(err)
+		return &RobotsRules{}, failed
+	}
+	started := time.Now()
+	body, retryAfter, err := getBodyOnce(robotsURL, NewSession(proxy, DefaultFetchSpec()))
+	if retryAfter < 0 {
+		ReleaseProxy(proxy, time.Since(started), nil)
+	} else {
+		ReleaseProxy(proxy, time.Since(started), err)
+	}
+
+	switch {
+	case err == nil:
+		return ParseRobots(strings.NewReader(body)), time.Now().Add(*robotsTTL)
+	case retryAfter < 0:
+		// 404 and alike
+		return &RobotsRules{}, time.Now().Add(*robotsTTL)
+	default:
+		glog.Errorln(err)
+		return &RobotsRules{}, failed
+	}
+}
+
+// checkRobots returns ErrDisallowed for pages robots.txt of the shop does
+// not let us load and applies its Crawl-delay to the host limiter
+func checkRobots(ctx context.Context, uri string, limiter *HostLimiter) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	robots, err := robotsCache.Get(ctx, u)
+	if err != nil {
+		return err
+	}
+	limiter.SetMinInterval(robots.CrawlDelay)
+	if !robots.Allowed(u.RequestURI()) {
+		return ErrDisallowed
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var sessions = Sessions{&sync.Mutex{}, map[string]*Session{}}
+
+// Session is how a shop sees us: the proxy and the browser behind it. The
+// profile sticks to the proxy, so every retry through the proxy sends the
+// same headers. For shops with a session spec it keeps cookies too.
+type Session struct {
+	Proxy   string
+	Profile *HeaderProfile
+	Fetch   FetchSpec
+
+	jar      http.CookieJar
+	key      string
+	requests int
+	// held while the warm-up request is made
+	warming *sync.Mutex
+	warm    bool
+}
+
+func NewSession(proxy string, fetch FetchSpec) *Session {
+	return &Session{Proxy: proxy, Profile: headerProfiles.ForProxy(proxy), Fetch: fetch}
+}
+
+// Do requests the page with the headers of the session browser and the
+// given ones within the shop timeouts. Redirects are not followed.
+func (s *Session) Do(uri string, header http.Header) (*http.Response, error) {
+	tr, err := transports.Get(s.Proxy, time.Duration(s.Fetch.ConnectTimeout), time.Duration(s.Fetch.HeaderTimeout))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range s.Profile.Headers {
+		req.Header.Set(name, value)
+	}
+	for name := range header {
+		req.Header.Set(name, header.Get(name))
+	}
+	client := &http.Client{
+		Transport: tr,
+		Jar:       s.jar,
+		Timeout:   time.Duration(s.Fetch.Timeout),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return client.Do(req)
+}
+
+// warmUp loads the page that gives the session its cookies, once. A
+// redirect is fine, the jar has got the cookies already. Any answer of the
+// shop ends the warm-up, a failing status is returned as a *StatusError
+// but asking the page again would not help.
+func (s *Session) warmUp(uri string) error {
+	s.warming.Lock()
+	defer s.warming.Unlock()
+	if s.warm {
+		return nil
+	}
+	resp, err := s.Do(uri, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	s.warm = true
+	if resp.StatusCode >= 400 {
+		return newStatusError(resp, uri, s.Fetch)
+	}
+	return nil
+}
+
+// Sessions keeps a cookie session per shop host and proxy
+type Sessions struct {
+	*sync.Mutex
+	sessions map[string]*Session
+}
+
+// Get returns the session of the host and proxy, a new one is started when
+// there is none or the old one made its max requests
+func (ss Sessions) Get(host, proxy string, fetch FetchSpec) (s *Session, created bool) {
+	key := host + " " + proxy
+	ss.Lock()
+	defer ss.Unlock()
+	s, ok := ss.sessions[key]
+	if !ok || fetch.Session.MaxRequests > 0 && s.requests >= fetch.Session.MaxRequests {
+		jar, _ := cookiejar.New(nil)
+		s = NewSession(proxy, fetch)
+		s.jar = jar
+		s.key = key
+		s.warming = &sync.Mutex{}
+		ss.sessions[key] = s
+		created = true
+	}
+	s.requests++
+	return s, created
+}
+
+// Renew drops the session, the next request to the host through the proxy
+// starts a new one
+func (ss Sessions) Renew(s *Session) {
+	ss.Lock()
+	defer ss.Unlock()
+	if ss.sessions[s.key] == s {
+		delete(ss.sessions, s.key)
+	}
+}
+
+// openSession returns the session the page is requested in, warmed up when
+// the shop asks for it
+func openSession(state *ParserState, uri, proxy string, fetch FetchSpec) (*Session, error) {
+	spec := fetch.Session
+	if spec == nil {
+		return NewSession(proxy, fetch), nil
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	s, created := sessions.Get(u.Host, proxy, fetch)
+	if created {
+		state.SetStat("sessions", 1)
+	}
+	if spec.WarmUp == "" {
+		return s, nil
+	}
+	warmUp, err := url.Parse(spec.WarmUp)
+	if err != nil {
+		return nil, err
+	}
+	err = s.warmUp(u.ResolveReference(warmUp).String())
+	if e, ok := err.(*StatusError); ok {
+		// the proxy did its job, the page is tried without the cookies
+		glog.Warningln(fmt.Sprintf("Session warm-up failed: %v", e))
+		state.SetStat("session-warm-up-failures", 1)
+		return s, nil
+	}
+	if err != nil {
+		sessions.Renew(s)
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestSessionWarmUp(t *testing.T) {
+	if err := LoadHeaderProfiles("headers.json"); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			http.SetCookie(w, &http.Cookie{Name: "region", Value: "kyiv"})
+			http.Redirect(w, r, "/ua/", http.StatusFound)
+		case "/p":
+			if c, err := r.Cookie("region"); err != nil || c.Value != "kyiv" {
+				http.Error(w, "no region", http.StatusForbidden)
+				return
+			}
+			w.Write([]byte("product"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		warmUp   string
+		failures int
+		body     string
+	}{
+		{"/", 0, "product"},
+		{"/missing", 1, ""},
+	}
+	for _, test := range tests {
+		sessions = Sessions{&sync.Mutex{}, map[string]*Session{}}
+		state := &ParserState{RWMutex: &sync.RWMutex{}, stats: map[string]int{}}
+		fetch := DefaultFetchSpec()
+		fetch.Session = &SessionSpec{WarmUp: test.warmUp}
+
+		s, err := openSession(state, srv.URL+"/p", "", fetch)
+		if err != nil {
+			t.Fatalf("%s: %v", test.warmUp, err)
+		}
+		if n := state.GetStat("session-warm-up-failures"); n != test.failures {
+			t.Errorf("%s: %d warm-up failures, want %d", test.warmUp, n, test.failures)
+		}
+		body, _, _ := getBodyOnce(srv.URL+"/p", s)
+		if body != test.body {
+			t.Errorf("%s: body %q, want %q", test.warmUp, body, test.body)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"reflect"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/html/charset"
+
+	"github.com/andybalholm/cascadia"
+	"github.com/golang/glog"
+)
+
+// Keys every shop names map must define, from inner to outer node
+var namesMapKeys = []string{"item", "items", "main", "outer"}
+
+type Selector struct {
+	Query string `json:"query"`
+	Last  bool   `json:"last"`
+}
+
+type AttributesSpec struct {
+	Rows           string   `json:"rows"`
+	Name           Selector `json:"name"`
+	Value          Selector `json:"value"`
+	TrimSuffix     string   `json:"trimSuffix"`
+	MaxValueLength int      `json:"maxValueLength"`
+}
+
+// AvailabilitySpec turns the text of an offer field into the available
+// attribute and drops the field from the output
+type AvailabilitySpec struct {
+	Field string `json:"field"`
+	Value string `json:"value"`
+}
+
+type OfferSpec struct {
+	Attrs  []string `json:"attrs"`
+	Fields []string `json:"fields"`
+}
+
+type ExtractorSpec struct {
+	StripQuery   bool                `json:"stripQuery"`
+	Required     *Selector           `json:"required"`
+	Fields       map[string]Selector `json:"fields"`
+	Attributes   *AttributesSpec     `json:"attributes"`
+	Availability *AvailabilitySpec   `json:"availability"`
+}
+
+// FetchSpec tells how product pages of the shop are requested
+type FetchSpec struct {
+	// Limits per shop host, the flags are used when not set
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	MaxConcurrency    int     `json:"maxConcurrency"`
+	// Timeouts of the connection, of the response headers and of the whole
+	// request with the body, the flags are used when not set
+	ConnectTimeout Duration `json:"connectTimeout"`
+	HeaderTimeout  Duration `json:"headerTimeout"`
+	Timeout        Duration `json:"timeout"`
+	// Bigger pages are not read, the flag is used when not set
+	MaxBodySize int64 `json:"maxBodySize"`
+	// Charset of pages that do not declare it, the flag is used when not set
+	Charset string `json:"charset"`
+	// How long fetched pages are served from the cache, the flag is used
+	// when not set and a negative one turns the cache off for the shop
+	CacheTTL Duration `json:"cacheTtl"`
+	// For partners who let us scrape what their robots.txt disallows
+	IgnoreRobots bool `json:"ignoreRobots"`
+	// Keep cookies for shops that set them before showing full pages
+	Session *SessionSpec `json:"session,omitempty"`
+	// Pages the shop shows bots instead of products
+	Block *BlockSpec `json:"block,omitempty"`
+}
+
+// SessionSpec makes requests through a proxy share cookies until the
+// session is renewed
+type SessionSpec struct {
+	// Page loaded first to get the cookies, e.g. "/"
+	WarmUp string `json:"warmUp"`
+	// Requests after which the session is renewed, 0 for no limit
+	MaxRequests int `json:"maxRequests"`
+}
+
+type Shop struct {
+	ID        string            `json:"id"`
+	Names     map[string]string `json:"names"`
+	UrlField  string            `json:"urlField"`
+	Offer     OfferSpec         `json:"offer"`
+	Extractor ExtractorSpec     `json:"extractor"`
+	Fetch     FetchSpec         `json:"fetch"`
+}
+
+type ShopsConfig struct {
+	Shops []*Shop `json:"shops"`
+}
+
+// LoadShops reads shop definitions and registers them in the registry
+func LoadShops(fileName string, registry *ShopRegistry) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var config ShopsConfig
+	if err := json.NewDecoder(file).Decode(&config); err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+	if len(config.Shops) == 0 {
+		return fmt.Errorf("%s: no shops defined", fileName)
+	}
+
+	for i, shop := range config.Shops {
+		shop.setDefaults()
+		if err := shop.Validate(); err != nil {
+			return fmt.Errorf("%s: shop #%d: %v", fileName, i+1, err)
+		}
+		if err := registry.Register(shop.Entry()); err != nil {
+			return fmt.Errorf("%s: %v", fileName, err)
+		}
+	}
+	return nil
+}
+
+func (s *Shop) setDefaults() {
+	defaults := DefaultFetchSpec()
+	if s.Fetch.RequestsPerSecond == 0 {
+		s.Fetch.RequestsPerSecond = defaults.RequestsPerSecond
+	}
+	if s.Fetch.MaxConcurrency == 0 {
+		s.Fetch.MaxConcurrency = defaults.MaxConcurrency
+	}
+	if s.Fetch.ConnectTimeout == 0 {
+		s.Fetch.ConnectTimeout = defaults.ConnectTimeout
+	}
+	if s.Fetch.HeaderTimeout == 0 {
+		s.Fetch.HeaderTimeout = defaults.HeaderTimeout
+	}
+	if s.Fetch.Timeout == 0 {
+		s.Fetch.Timeout = defaults.Timeout
+	}
+	if s.Fetch.MaxBodySize == 0 {
+		s.Fetch.MaxBodySize = defaults.MaxBodySize
+	}
+	if s.Fetch.Charset == "" {
+		s.Fetch.Charset = defaults.Charset
+	}
+	if s.Fetch.CacheTTL == 0 {
+		s.Fetch.CacheTTL = defaults.CacheTTL
+	}
+}
+
+// DefaultFetchSpec is made of the flags, for shops that do not set their
+// own values and for requests outside of shops
+func DefaultFetchSpec() FetchSpec {
+	return FetchSpec{
+		RequestsPerSecond: *hostRps,
+		MaxConcurrency:    *hostConcurrency,
+		ConnectTimeout:    Duration(*connectTimeout),
+		HeaderTimeout:     Duration(*headerTimeout),
+		Timeout:           Duration(*fetchTimeout),
+		MaxBodySize:       *maxBodySize,
+		Charset:           *defaultCharset,
+		CacheTTL:          Duration(*cacheTTL),
+	}
+}
+
+// Duration is a time.Duration written as "10s" in JSON
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (s *Shop) Validate() error {
+	if s.ID == "" {
+		return fmt.Errorf("missing id")
+	}
+	if len(s.Offer.Fields) == 0 {
+		return fmt.Errorf("%s: offer has no fields", s.ID)
+	}
+
+	fields := Set{}
+	for _, f := range s.Offer.Fields {
+		fields[f] = struct{}{}
+	}
+	if _, ok := fields[s.UrlField]; !ok {
+		return fmt.Errorf("%s: url field %q is not an offer field", s.ID, s.UrlField)
+	}
+
+	e := s.Extractor
+	if e.Required != nil {
+		if err := e.Required.Validate(); err != nil {
+			return fmt.Errorf("%s: required: %v", s.ID, err)
+		}
+	}
+	for field, selector := range e.Fields {
+		if _, ok := fields[field]; !ok {
+			return fmt.Errorf("%s: extracted field %q is not an offer field", s.ID, field)
+		}
+		if err := selector.Validate(); err != nil {
+			return fmt.Errorf("%s: field %s: %v", s.ID, field, err)
+		}
+	}
+	if a := e.Attributes; a != nil {
+		if _, err := cascadia.Compile(a.Rows); err != nil {
+			return fmt.Errorf("%s: attribute rows: %v", s.ID, err)
+		}
+		if err := a.Name.Validate(); err != nil {
+			return fmt.Errorf("%s: attribute name: %v", s.ID, err)
+		}
+		if err := a.Value.Validate(); err != nil {
+			return fmt.Errorf("%s: attribute value: %v", s.ID, err)
+		}
+	}
+	if a := e.Availability; a != nil && a.Field == "" {
+		return fmt.Errorf("%s: availability has no field", s.ID)
+	}
+	if s.Fetch.RequestsPerSecond < 0 || s.Fetch.MaxConcurrency < 1 {
+		return fmt.Errorf("%s: bad rate limit", s.ID)
+	}
+	if s.Fetch.ConnectTimeout < 0 || s.Fetch.HeaderTimeout < 0 || s.Fetch.Timeout < 0 || s.Fetch.MaxBodySize < 0 {
+		return fmt.Errorf("%s: bad timeouts or max body size", s.ID)
+	}
+	if e, _ := charset.Lookup(s.Fetch.Charset); e == nil {
+		return fmt.Errorf("%s: unknown charset %q", s.ID, s.Fetch.Charset)
+	}
+	if ss := s.Fetch.Session; ss != nil {
+		if ss.MaxRequests < 0 {
+			return fmt.Errorf("%s: bad session max requests", s.ID)
+		}
+		if _, err := url.Parse(ss.WarmUp); err != nil {
+			return fmt.Errorf("%s: session warm up: %v", s.ID, err)
+		}
+	}
+	if b := s.Fetch.Block; b != nil {
+		if err := b.compile(); err != nil {
+			return fmt.Errorf("%s: block: %v", s.ID, err)
+		}
+	}
+	return nil
+}
+
+func (s Selector) Validate() error {
+	_, err := cascadia.Compile(s.Query)
+	return err
+}
+
+func (s *Shop) Entry() ShopEntry {
+	return ShopEntry{
+		ID:        s.ID,
+		NamesMap:  s.Names,
+		OfferType: reflect.TypeOf(Offer{}),
+		NewExtractor: func() ProductExtractor {
+			return &Offer{shop: s}
+		},
+	}
+}
+
+type ShopFeedParser struct {
+	FeedReader
+	shop ShopEntry
+}
+
+func (e ShopFeedParser) ParseFeed(ctx context.Context, feedFile multipart.File) {
+	e.waitGroup.Add(1)
+	e.parserState.SetStat("reading-uri", 1)
+	go func() {
+		defer func() {
+			glog.Infoln("Uri reader finished")
+			e.waitGroup.Done()
+			e.parserState.SetStat("reading-uri", -1)
+			feedFile.Close()
+		}()
+
+		glog.Infoln("Uri reader started")
+		XMLParse(ctx, feedFile, e.productExtractorChan, e.startTokensChan,
+			e.endTokensChan, e.shop.NamesMap, e.shop.NewExtractor)
+	}()
+}
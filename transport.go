@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var transports = Transports{&sync.Mutex{}, map[transportKey]*http.Transport{}}
+
+type transportKey struct {
+	proxy   string
+	connect time.Duration
+	header  time.Duration
+}
+
+// Transports keeps a connection pool per proxy, shops with the same
+// timeouts share it
+type Transports struct {
+	*sync.Mutex
+	transports map[transportKey]*http.Transport
+}
+
+func (t Transports) Get(proxy string, connect, header time.Duration) (*http.Transport, error) {
+	key := transportKey{proxy, connect, header}
+	t.Lock()
+	defer t.Unlock()
+	if tr, ok := t.transports[key]; ok {
+		return tr, nil
+	}
+
+	tr := &http.Transport{
+		Dial: (&net.Dialer{
+			Timeout:   connect,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout:   connect,
+		ResponseHeaderTimeout: header,
+		MaxIdleConnsPerHost:   *hostConcurrency,
+		// readBody decodes what the header profile asked for
+		DisableCompression: true,
+	}
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, err
+		}
+		tr.Proxy = http.ProxyURL(u)
+	}
+	t.transports[key] = tr
+	return tr, nil
+}
+
+// Close drops the pools of the proxy, e.g. when it is gone with a reload
+func (t Transports) Close(proxy string) {
+	t.Lock()
+	defer t.Unlock()
+	for key, tr := range t.transports {
+		if key.proxy == proxy {
+			tr.CloseIdleConnections()
+			delete(t.transports, key)
+		}
+	}
+}
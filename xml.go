@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/xml"
 	"io"
-	"reflect"
 
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
@@ -15,17 +14,22 @@ type Attribute struct {
 	Value   string   `xml:",chardata"`
 }
 
-var YML_NAMES_MAP = map[string]string{
-	"items": "offers",
-	"item":  "offer",
-	"main":  "shop",
-	"outer": "yml_catalog",
-}
-
+// XMLParse sends feed items to scrappers and all other tokens to the writer.
+// Tokens up to the end of the items block go to startChan, the rest goes to
+// endChan to be written after the last item.
 func XMLParse(ctx context.Context, feed io.Reader,
-	scrapperC chan<- ProductExtractor, startChan chan<- xml.Token,
-	namesMap map[string]string, t reflect.Type) {
+	scrapperC chan<- ProductExtractor, startChan, endChan chan<- xml.Token,
+	namesMap map[string]string, newItem func() ProductExtractor) {
 	decoder := xml.NewDecoder(feed)
+	tokensChan := startChan
+	forward := func(token xml.Token) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case tokensChan <- xml.CopyToken(token):
+			return true
+		}
+	}
 	for i := 0; i != *urlLimit; {
 		select {
 		case <-ctx.Done():
@@ -39,27 +43,31 @@ func XMLParse(ctx context.Context, feed io.Reader,
 			switch element := token.(type) {
 			case xml.StartElement:
 				if element.Name.Local == namesMap["item"] {
-					v := reflect.New(t).Interface()
-					err := decoder.DecodeElement(&v, &element)
+					v := newItem()
+					err := decoder.DecodeElement(v, &element)
 					if err != nil {
 						glog.Errorln(err)
-					} else {
-						i++
-						scrapperC <- v.(ProductExtractor)
+						continue
 					}
-				} else {
-					startChan <- xml.CopyToken(token)
+					i++
+					select {
+					case <-ctx.Done():
+						return
+					case scrapperC <- v:
+					}
+				} else if !forward(token) {
+					return
 				}
 			case xml.CharData:
-				if element[0] != byte(10) {
-					startChan <- xml.CopyToken(token)
+				if element[0] != byte(10) && !forward(token) {
+					return
 				}
 			case xml.EndElement:
-				itsItems := element.Name.Local == namesMap["items"]
-				itsMain := element.Name.Local == namesMap["main"]
-				itsOuter := element.Name.Local == namesMap["outer"]
-				if !(itsItems || itsMain || itsOuter) {
-					startChan <- xml.CopyToken(token)
+				if element.Name.Local == namesMap["items"] {
+					tokensChan = endChan
+				}
+				if !forward(token) {
+					return
 				}
 			}
 		}